@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -17,7 +19,11 @@ import (
 	"github.com/andreich/docsync/crypt"
 	"github.com/andreich/docsync/manifest"
 	"github.com/andreich/docsync/mover"
+	"github.com/andreich/docsync/online"
+	"github.com/andreich/docsync/signals"
 	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/uploader"
+	"github.com/andreich/docsync/watch"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 )
@@ -33,6 +39,10 @@ func uploadContent(ctx context.Context, s storage.Storage, enc crypt.Encryption,
 	if err != nil {
 		return err
 	}
+	return store(ctx, s, dst, data)
+}
+
+func store(ctx context.Context, s storage.Storage, dst string, data []byte) error {
 	if *dryRun {
 		log.Printf("dry run: uploading to %s (%d bytes)", dst, len(data))
 		return nil
@@ -40,22 +50,131 @@ func uploadContent(ctx context.Context, s storage.Storage, enc crypt.Encryption,
 	return s.Upload(ctx, dst, data)
 }
 
+// dryRunStorage only logs uploads.
+type dryRunStorage struct {
+	storage.Storage
+}
+
+func (d dryRunStorage) Upload(ctx context.Context, name string, contents []byte) error {
+	log.Printf("dry run: uploading to %s (%d bytes)", name, len(contents))
+	return nil
+}
+
 func upload(ctx context.Context, s storage.Storage, enc crypt.Encryption, srcfilename, dstfilename string) error {
-	data, err := ioutil.ReadFile(srcfilename)
+	f, err := os.Open(srcfilename)
 	if err != nil {
 		return err
 	}
-	return uploadContent(ctx, s, enc, dstfilename, data)
+	defer f.Close()
+	r := crypt.EncryptReader(enc, f)
+	defer r.Close()
+	if *dryRun {
+		n, err := io.Copy(ioutil.Discard, r)
+		log.Printf("dry run: uploading to %s (%d bytes)", dstfilename, n)
+		return err
+	}
+	return s.Put(ctx, dstfilename, r, nil)
 }
 
-func main() {
-	flag.Parse()
-	ctx := context.Background()
+// loadManifest returns the newest of the local and remote manifests, or an
+// empty one if neither can be loaded, and whether the remote one is missing or
+// older, to upload it again.
+func loadManifest(ctx context.Context, s storage.Storage, enc crypt.Encryption, cfg *config.Sync) (m manifest.Manifest, remoteStale bool, err error) {
+	local, err := manifest.Open(cfg.ManifestFile, cfg.Include, cfg.Exclude)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not load manifest from local file %q: %v", cfg.ManifestFile, err)
+	}
+	var remote manifest.Manifest
+	data, err := s.Download(ctx, cfg.RemoteManifestFile)
+	if storage.IsNotExist(err) {
+		log.Printf("Remote manifest file %q does not exist yet", cfg.RemoteManifestFile)
+	} else if err != nil {
+		// Starting with an empty manifest would upload everything again.
+		if local == nil {
+			return nil, false, fmt.Errorf("could not download remote manifest file %q, and no local manifest: %v", cfg.RemoteManifestFile, err)
+		}
+		log.Printf("Could not download remote manifest file %q, using the local one: %v", cfg.RemoteManifestFile, err)
+	} else {
+		data, err := enc.Decrypt(data)
+		if err != nil {
+			// Retrying would not help, and neither would starting empty.
+			if local == nil {
+				log.Fatalf("Could not decrypt remote manifest file %q, and no local manifest: %v", cfg.RemoteManifestFile, err)
+			}
+			log.Printf("Could not decrypt remote manifest file %q, using the local one: %v", cfg.RemoteManifestFile, err)
+		} else {
+			remote = manifest.New(cfg.Include, cfg.Exclude)
+			if err := remote.Load(bytes.NewReader(data)); err != nil {
+				log.Printf("Could not load manifest from remote file: %v", err)
+				remote = nil
+			}
+		}
+	}
+	remoteStale = remote == nil
+	m = manifest.Newest(local, remote)
+	if m == nil {
+		log.Printf("Initializing empty manifest")
+		return manifest.New(cfg.Include, cfg.Exclude), remoteStale, nil
+	}
+	if !remoteStale && m.Saved().After(remote.Saved()) {
+		remoteStale = true
+	}
+	if m == local {
+		log.Printf("Using manifest from local file %q, saved at %v", cfg.ManifestFile, m.Saved())
+	} else {
+		log.Printf("Using manifest from remote file %q, saved at %v", cfg.RemoteManifestFile, m.Saved())
+	}
+	return m, remoteStale, nil
+}
+
+// newSyncer sets up encryption with the key derivation parameters from the
+// storage, and loads the manifest. It returns an error if the storage fails,
+// to try again later.
+func newSyncer(ctx context.Context, s storage.Storage, cfg *config.Sync, retry *storage.RetryPolicy) (*syncer, error) {
+	var paramsStore crypt.ParamsStore = s
+	if *dryRun {
+		paramsStore = dryRunStorage{s}
+	}
+	params, err := crypt.LoadOrCreateParams(ctx, paramsStore, cfg.KDFParamsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load key derivation parameters from %q: %v", cfg.KDFParamsFile, err)
+	}
+	enc, err := crypt.New(cfg.AESPassphrase, crypt.WithParams(params), crypt.WithCompression(cfg.Compress), crypt.WithLegacyCBC(cfg.LegacyCBC()))
+	if err != nil {
+		log.Fatalf("Could not set up encryption/decryption: %v", err)
+	}
+	m, remoteStale, err := loadManifest(ctx, s, enc, cfg)
+	if err != nil {
+		return nil, err
+	}
+	sy := &syncer{
+		s:           s,
+		enc:         enc,
+		m:           m,
+		cfg:         cfg,
+		retry:       retry,
+		remoteStale: remoteStale,
+	}
+	sy.pool = uploader.New(cfg.UploadConcurrency, cfg.UploadTimeout.Duration, cfg.UploadMemory, sy.upload)
+	return sy, nil
+}
 
-	tctx, _ := context.WithTimeout(ctx, 10*time.Minute)
-	if err := waitForInternetAccess(tctx); err != nil {
-		log.Fatalf("No internet access available: %v", err)
+// saveManifest writes the manifest to the local file, unless in dry run where
+// it records uploads that did not happen.
+func saveManifest(m manifest.Manifest, filename string) error {
+	if *dryRun {
+		log.Printf("dry run: saving manifest to %s", filename)
+		return nil
 	}
+	return manifest.Save(m, filename)
+}
+
+// shutdownTimeout bounds uploading the manifest when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	flag.Parse()
+	ctx, syncNow := signals.Handle()
 
 	*configFile = os.ExpandEnv(*configFile)
 	log.Printf("Started with config: %s", *configFile)
@@ -82,22 +201,31 @@ func main() {
 	}
 	mv := mover.New(cfgMover.Mover)
 
-	enc, err := crypt.New(cfg.AESPassphrase)
+	s, err := storage.FromConfig(ctx, &cfg.Storage)
 	if err != nil {
-		log.Fatalf("Could not set up encryption/decryption with passphrase %q: %v", cfg.AESPassphrase, err)
+		log.Fatalf("Could not initialize storage: %v", err)
 	}
-
-	creds, err := json.Marshal(cfg.Credentials)
-	if err != nil {
-		log.Fatalf("Could not serialize credentials: %v", err)
+	retry := storage.DefaultRetryPolicy()
+	retry.OnRetry = func(op string, err error) {
+		log.Printf("Retrying %s: %v", op, err)
+		stats.Record(ctx, storageRetriesCounter.M(1))
 	}
-	s, err := storage.New(ctx, cfg.BucketName, creds)
-	if err != nil {
-		log.Fatalf("Could not initialize storage: %v", err)
+	// Probing goes around the retries, to find out quickly.
+	probe := online.StorageProbe(s, cfg.RemoteManifestFile, storage.IsRejected)
+	if cfg.ProbeURL != "" {
+		probe = online.HTTPProbe(&http.Client{}, cfg.ProbeURL)
 	}
+	checker := online.New(probe)
+	s = storage.WithRetry(s, retry)
 
-	if err := setupStackdriverExport(cfg.Credentials["project_id"], creds); err != nil {
-		log.Printf("Could not set up Stackdriver export: %v", err)
+	if cfg.Type == config.StorageGCS {
+		creds, err := json.Marshal(cfg.Credentials)
+		if err != nil {
+			log.Fatalf("Could not serialize credentials: %v", err)
+		}
+		if err := setupStackdriverExport(cfg.Credentials["project_id"], creds); err != nil {
+			log.Printf("Could not set up Stackdriver export: %v", err)
+		}
 	}
 
 	view.SetReportingPeriod(cfg.Interval.Duration / 2)
@@ -106,57 +234,143 @@ func main() {
 		log.Fatalf("Could not set up view for monitoring: %v", err)
 	}
 
-	m := manifest.New(cfg.Include, cfg.Exclude)
-	data, err := s.Download(ctx, cfg.RemoteManifestFile)
-	if err != nil {
-		log.Printf("Could not restore manifest from remote file %q: %v", cfg.RemoteManifestFile, err)
-		log.Printf("Initializing empty manifest")
-	} else {
-		data, err := enc.Decrypt(data)
+	var sy *syncer
+	// ready probes the storage, and sets up the syncer the first time it is
+	// reachable: the key derivation parameters are needed to encrypt
+	// anything, and the manifest to find the changes.
+	ready := func() bool {
+		isOnline, err := checker.Online(ctx)
 		if err != nil {
-			log.Fatalf("Could not decrypt remote manifest file: %v", err)
+			log.Fatalf("Storage refuses the requests: %v", err)
+		}
+		if !isOnline || sy != nil {
+			return isOnline
+		}
+		if sy, err = newSyncer(ctx, s, cfg, retry); err != nil {
+			if storage.IsRejected(err) {
+				log.Fatalf("Could not start syncing: %v", err)
+			}
+			log.Printf("Could not start syncing: %v", err)
+			return false
 		}
-		var buf bytes.Buffer
-		if _, err := buf.Write(data); err != nil {
-			log.Fatalf("Could not write remote manifest file to buffer: %v", err)
+		return true
+	}
+
+	var watched <-chan []string
+	if cfg.Watch {
+		var dirs []string
+		for src := range cfg.Dirs {
+			dirs = append(dirs, src)
 		}
-		if err := m.Load(&buf); err != nil {
-			log.Printf("Could not load manifest from remote file: %v", err)
+		dirs = append(dirs, cfgMover.Mover.From...)
+		w, err := watch.New(dirs, cfg.WatchDelay.Duration)
+		if err != nil {
+			log.Printf("Could not watch for changes, scanning every %v only: %v", cfg.Interval, err)
+		} else {
+			defer w.Close()
+			watched = w.C()
 		}
 	}
 	for {
+		if ctx.Err() != nil {
+			// Uploads in flight were aborted, and stay pending.
+			if sy != nil {
+				flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				sy.finishCycle(flushCtx)
+				cancel()
+			}
+			log.Printf("Shut down")
+			return
+		}
 		if _, err := mv.Scan(*dryRun); err != nil {
 			log.Printf("Could not perform moves: %v", err)
 		}
-
-		changedEntries := 0
-		for src, dst := range cfg.Dirs {
-			changed, err := m.Update(src)
-			if err != nil {
-				log.Printf("Breaking update loop due to error: %v", err)
-				break
-			}
-			for _, e := range changed {
-				changedEntries++
-				dstfn := strings.Replace(e, src, dst, 1)
-				if err := upload(ctx, s, enc, e, dstfn); err != nil {
-					log.Printf("Could not upload %q to %q: %v", e, dstfn, err)
-					stats.Record(ctx, uploadedFilesErrCounter.M(1))
+		// While offline, changes stay on disk until the next full scan.
+		isOnline := ready()
+		sleep := cfg.Interval.Duration
+		if isOnline {
+			changedEntries := 0
+			for src, dst := range cfg.Dirs {
+				n, err := sy.syncDir(ctx, src, dst, src)
+				changedEntries += n
+				if err != nil {
+					log.Printf("Breaking update loop due to error: %v", err)
+					break
 				}
-				stats.Record(ctx, uploadedFilesCounter.M(1))
 			}
+			sy.finishCycle(ctx)
+			log.Printf("Changed entries %d; Sleeping %v", changedEntries, sleep)
+		} else {
+			sleep = cfg.ProbeInterval.Duration
+			log.Printf("Storage not reachable, pausing uploads; Sleeping %v", sleep)
 		}
-		if changedEntries > 0 {
-			var buf bytes.Buffer
-			if err := m.Dump(&buf); err != nil {
-				log.Printf("Could not dump manifest to buffer: %v", err)
-				break
+
+		next := time.After(sleep)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				break wait
+			case <-next:
+				break wait
+			case <-syncNow:
+				log.Printf("Received SIGUSR1, syncing now")
+				break wait
+			case dirs := <-watched:
+				changedEntries := 0
+				if anyUnder(dirs, cfgMover.Mover.From) {
+					if _, err := mv.Scan(*dryRun); err != nil {
+						log.Printf("Could not perform moves: %v", err)
+					}
+				}
+				if !isOnline {
+					continue
+				}
+				if isOnline = ready(); !isOnline {
+					// Back to probing regularly.
+					break wait
+				}
+				// Files moved between the directories of a synced
+				// directory are found as renamed together.
+				for src, dst := range cfg.Dirs {
+					var within []string
+					for _, dir := range dirs {
+						if under(dir, src) {
+							within = append(within, dir)
+						}
+					}
+					if len(within) == 0 {
+						continue
+					}
+					n, err := sy.syncDir(ctx, src, dst, within...)
+					changedEntries += n
+					if err != nil {
+						log.Printf("Could not update %v: %v", within, err)
+					}
+				}
+				sy.finishCycle(ctx)
+				if changedEntries > 0 {
+					log.Printf("Changed entries %d in %v", changedEntries, dirs)
+				}
 			}
-			if err := uploadContent(ctx, s, enc, cfg.RemoteManifestFile, buf.Bytes()); err != nil {
-				log.Printf("Could not upload %q to %q: %v", cfg.ManifestFile, cfg.RemoteManifestFile, err)
+		}
+	}
+}
+
+// under reports whether fn is dir or within it.
+func under(fn, dir string) bool {
+	fn, dir = filepath.Clean(fn), filepath.Clean(dir)
+	return fn == dir || strings.HasPrefix(fn, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// anyUnder reports whether any of fns is within any of dirs.
+func anyUnder(fns, dirs []string) bool {
+	for _, fn := range fns {
+		for _, dir := range dirs {
+			if under(fn, dir) {
+				return true
 			}
 		}
-		log.Printf("Changed entries %d; Sleeping %v", changedEntries, cfg.Interval)
-		time.Sleep(cfg.Interval.Duration)
 	}
+	return false
 }
@@ -16,6 +16,10 @@ import (
 var (
 	uploadedFilesCounter    = stats.Int64("uploaded_files", "The number of files uploaded.", "1")
 	uploadedFilesErrCounter = stats.Int64("uploaded_files_errors", "The number of errors when uploading.", "1")
+	deletedFilesCounter     = stats.Int64("deleted_files", "The number of remote files deleted or moved to trash.", "1")
+	storageRetriesCounter   = stats.Int64("storage_retries", "The number of storage operations retried.", "1")
+	dedupedFilesCounter     = stats.Int64("deduped_files", "The number of files not uploaded as their contents were stored already.", "1")
+	renamedFilesCounter     = stats.Int64("renamed_files", "The number of files renamed without uploading them.", "1")
 )
 
 func setupPrometheusExport(mux *http.ServeMux) error {
@@ -73,5 +77,25 @@ func registerViews() error {
 		Description: "Number of errors over time",
 		Measure:     uploadedFilesErrCounter,
 		Aggregation: view.Count(),
+	}, &view.View{
+		Name:        "deleted_files_count",
+		Description: "Number of remote files deleted over time",
+		Measure:     deletedFilesCounter,
+		Aggregation: view.Count(),
+	}, &view.View{
+		Name:        "storage_retries_count",
+		Description: "Number of storage operations retried over time",
+		Measure:     storageRetriesCounter,
+		Aggregation: view.Count(),
+	}, &view.View{
+		Name:        "deduped_files_count",
+		Description: "Number of files stored already over time",
+		Measure:     dedupedFilesCounter,
+		Aggregation: view.Count(),
+	}, &view.View{
+		Name:        "renamed_files_count",
+		Description: "Number of files renamed over time",
+		Measure:     renamedFilesCounter,
+		Aggregation: view.Count(),
 	})
 }
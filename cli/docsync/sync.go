@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andreich/docsync/config"
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/snapshot"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/uploader"
+	"github.com/andreich/docsync/versions"
+	"go.opencensus.io/stats"
+)
+
+// syncer syncs the changes found by the manifest to storage.
+type syncer struct {
+	s     storage.Storage
+	enc   crypt.Encryption
+	m     manifest.Manifest
+	cfg   *config.Sync
+	pool  *uploader.Pool
+	retry *storage.RetryPolicy
+
+	// remoteStale is set when the remote manifest misses changes.
+	remoteStale bool
+	// lastSnapshot is when the last snapshot was recorded.
+	lastSnapshot time.Time
+	// pinned holds the names of the objects referred to by snapshots, see
+	// snapshot.Pinned. It is nil until the snapshots are read.
+	pinned map[string]bool
+}
+
+// uploadMemory returns the memory used by uploading a file of size bytes: a
+// chunk buffered by the encryption, and what the storage buffers.
+func (sy *syncer) uploadMemory(size int64) int64 {
+	return crypt.ChunkSize + storage.PutBuffer(&sy.cfg.Storage, size)
+}
+
+// upload retries uploading the whole file, as streamed uploads cannot be
+// retried by storage.
+func (sy *syncer) upload(ctx context.Context, job uploader.Job) error {
+	return sy.retry.Do(ctx, "upload of "+job.Src, func(int) error {
+		if sy.cfg.Layout == config.LayoutContent {
+			return uploadBlob(ctx, sy.s, sy.enc, job)
+		}
+		return upload(ctx, sy.s, sy.enc, job.Src, job.Dst)
+	})
+}
+
+// uploadBlob uploads the file stored by content, deleting it if the file no
+// longer has the contents it is named after.
+func uploadBlob(ctx context.Context, s storage.Storage, enc crypt.Encryption, job uploader.Job) error {
+	f, err := os.Open(job.Src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	r := crypt.EncryptReader(enc, io.TeeReader(f, h))
+	defer r.Close()
+	if *dryRun {
+		n, err := io.Copy(ioutil.Discard, r)
+		log.Printf("dry run: uploading to %s (%d bytes)", job.Dst, n)
+		return err
+	}
+	if err := s.Put(ctx, job.Dst, r, nil); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), job.Hash[:]) {
+		if err := s.Delete(ctx, job.Dst); err != nil {
+			log.Printf("Could not delete %q, uploaded with other contents than its name: %v", job.Dst, err)
+		}
+		return fmt.Errorf("%s changed while uploading", job.Src)
+	}
+	return nil
+}
+
+// syncDir uploads the changes in dirs, within the synced directory src, to the
+// remote directory dst. Files moved between dirs are renamed. It returns the
+// number of changes.
+func (sy *syncer) syncDir(ctx context.Context, src, dst string, dirs ...string) (int, error) {
+	sy.readSnapshots(ctx)
+	changes, err := sy.m.Diff(dirs...)
+	if err != nil {
+		return 0, err
+	}
+	content := sy.cfg.Layout == config.LayoutContent
+	var jobs []uploader.Job
+	// waiting are the files with the same contents as the file of an upload
+	// in this cycle, by object, committed once it is uploaded.
+	waiting := make(map[string][]string)
+	for _, c := range changes {
+		e := c.Path
+		dstfn := strings.Replace(e, src, dst, 1)
+		if c.Kind == manifest.Removed {
+			if err := sy.remove(ctx, c, dstfn); storage.IsNotExist(err) {
+				log.Printf("Remote copy %q of deleted %q not found", dstfn, e)
+			} else if err != nil {
+				log.Printf("Could not apply %s policy to %q: %v", sy.cfg.OnDelete, dstfn, err)
+			} else if sy.cfg.OnDelete != config.OnDeleteIgnore {
+				stats.Record(ctx, deletedFilesCounter.M(1))
+			}
+			continue
+		}
+		if c.Kind == manifest.Renamed {
+			err := sy.rename(ctx, c, strings.Replace(c.From, src, dst, 1), dstfn)
+			if err == nil {
+				stats.Record(ctx, renamedFilesCounter.M(1))
+				continue
+			}
+			if !storage.IsNotExist(err) {
+				log.Printf("Could not rename %q to %q, will retry: %v", c.From, e, err)
+				stats.Record(ctx, uploadedFilesErrCounter.M(1))
+				continue
+			}
+			log.Printf("Remote copy of %q renamed to %q not found, uploading it", c.From, e)
+		}
+		if err := sy.keepVersion(ctx, e, dstfn); err != nil {
+			log.Printf("Could not keep the previous version of %q, will retry: %v", dstfn, err)
+			stats.Record(ctx, uploadedFilesErrCounter.M(1))
+			continue
+		}
+		job := uploader.Job{Src: e, Dst: dstfn}
+		if content {
+			entry, _ := sy.m.Lookup(e)
+			job.Dst, job.Hash = remote.Blob(sy.enc, sy.cfg.BlobsPrefix, entry.Hash), entry.Hash
+			if _, err := sy.s.Stat(ctx, job.Dst); err == nil {
+				// Stored already, for another file or an earlier version.
+				sy.commitObject(ctx, e, job.Dst)
+				stats.Record(ctx, dedupedFilesCounter.M(1))
+				continue
+			} else if !storage.IsNotExist(err) {
+				log.Printf("Could not check for %q of %q, will retry: %v", job.Dst, e, err)
+				stats.Record(ctx, uploadedFilesErrCounter.M(1))
+				continue
+			}
+			if srcs, found := waiting[job.Dst]; found {
+				waiting[job.Dst] = append(srcs, e)
+				continue
+			}
+			waiting[job.Dst] = nil
+		}
+		if st, err := os.Stat(e); err == nil {
+			job.Memory = sy.uploadMemory(st.Size())
+		}
+		jobs = append(jobs, job)
+	}
+	sy.pool.Run(ctx, jobs, func(job uploader.Job, err error) {
+		switch {
+		case err != nil:
+			log.Printf("Could not upload %q to %q, will retry: %v", job.Src, job.Dst, err)
+			stats.Record(ctx, uploadedFilesErrCounter.M(1))
+		case content:
+			sy.commitObject(ctx, job.Src, job.Dst)
+			for _, src := range waiting[job.Dst] {
+				sy.commitObject(ctx, src, job.Dst)
+				stats.Record(ctx, dedupedFilesCounter.M(1))
+			}
+		default:
+			sy.m.Commit(job.Src)
+		}
+		stats.Record(ctx, uploadedFilesCounter.M(1))
+	})
+	if len(changes) > 0 {
+		sy.remoteStale = true
+	}
+	return len(changes), nil
+}
+
+// commitObject commits the file src stored by content in object, and releases
+// the object which held its previous contents, unless kept as a version.
+func (sy *syncer) commitObject(ctx context.Context, src, object string) {
+	e, _ := sy.m.Lookup(src)
+	sy.m.CommitObject(src, object)
+	if e.Stored != nil && e.Stored.Name != "" && e.Stored.Name != object {
+		sy.release(ctx, []string{e.Stored.Name})
+	}
+}
+
+// keepVersion keeps the remote copy of the modified file src as a version,
+// if versions are kept, and deletes the versions of src expired by the
+// retention policy. Files stored under their path are copied before dst is
+// overwritten, while files stored by content keep their object. Without
+// versions, only the copies pinned by snapshots are made.
+func (sy *syncer) keepVersion(ctx context.Context, src, dst string) error {
+	e, found := sy.m.Lookup(src)
+	if !found || e.Stored == nil || e.Stored.Hash == e.Hash {
+		return nil
+	}
+	if !sy.cfg.Versions.Enabled() {
+		if e.Stored.Name != "" {
+			return nil
+		}
+		return sy.pin(ctx, dst, e.Stored.Mod)
+	}
+	v := *e.Stored
+	byPath := v.Name == ""
+	if byPath {
+		v.Name = versions.Name(sy.cfg.VersionsPrefix, dst, v.Mod)
+	}
+	for _, old := range e.Versions {
+		if old.Name == v.Name {
+			// Kept by an earlier attempt to upload the file, or the
+			// same contents stored by content.
+			return nil
+		}
+	}
+	if *dryRun {
+		log.Printf("dry run: keeping %s as %s", dst, v.Name)
+		return nil
+	}
+	if byPath {
+		if err := sy.copyOnce(ctx, dst, v.Name); storage.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	kept, expired := sy.cfg.Versions.Apply(append(e.Versions, v))
+	sy.m.SetVersions(src, kept)
+	var names []string
+	for _, old := range expired {
+		names = append(names, old.Name)
+	}
+	if failed := sy.release(ctx, names); len(failed) > 0 {
+		// Deleted with a later version.
+		for _, old := range expired {
+			if failed[old.Name] {
+				kept = append(kept, old)
+			}
+		}
+		sort.Slice(kept, func(a, b int) bool { return kept[a].Mod.Before(kept[b].Mod) })
+		sy.m.SetVersions(src, kept)
+	}
+	return nil
+}
+
+// rename commits the file renamed by c, stored by content or else as from,
+// without uploading it. Files stored under their path are copied to dst, and
+// their remote copy is deleted unless deleted files are ignored.
+func (sy *syncer) rename(ctx context.Context, c manifest.Change, from, dst string) error {
+	e, found := sy.m.Lookup(c.Path)
+	if !found || e.Stored == nil {
+		// Nothing stored to rename.
+		return storage.ErrNotExist
+	}
+	if e.Stored.Name != "" {
+		sy.commitObject(ctx, c.Path, e.Stored.Name)
+		return nil
+	}
+	if err := sy.pin(ctx, from, e.Stored.Mod); err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("dry run: moving %s to %s", from, dst)
+		sy.m.Commit(c.Path)
+		return nil
+	}
+	if err := sy.s.Copy(ctx, from, dst); err != nil {
+		return err
+	}
+	sy.m.Commit(c.Path)
+	if sy.cfg.OnDelete == config.OnDeleteIgnore {
+		return nil
+	}
+	if err := sy.s.Delete(ctx, from); err != nil && !storage.IsNotExist(err) {
+		log.Printf("Could not delete %q, renamed to %q: %v", from, dst, err)
+	}
+	return nil
+}
+
+// remove applies the policy for files deleted locally to their remote copy,
+// the object of c if stored by content, or else dstfn.
+func (sy *syncer) remove(ctx context.Context, c manifest.Change, dstfn string) error {
+	obj := dstfn
+	if c.Object != "" {
+		obj = c.Object
+	} else if err := sy.pin(ctx, dstfn, c.Mod); err != nil {
+		// Even if ignored, as another file may take its name.
+		return err
+	}
+	var trash string
+	switch sy.cfg.OnDelete {
+	case config.OnDeleteDelete:
+	case config.OnDeleteTrash:
+		trash = sy.cfg.TrashPrefix + dstfn
+	default:
+		return nil
+	}
+	if *dryRun {
+		if trash != "" {
+			log.Printf("dry run: moving %s to %s", obj, trash)
+		} else {
+			log.Printf("dry run: deleting %s", obj)
+		}
+		return nil
+	}
+	if trash != "" {
+		if err := sy.s.Copy(ctx, obj, trash); err != nil {
+			return err
+		}
+	}
+	if c.Object == "" {
+		return sy.s.Delete(ctx, obj)
+	}
+	if failed := sy.release(ctx, []string{obj}); failed[obj] {
+		return fmt.Errorf("could not delete %s", obj)
+	}
+	return nil
+}
+
+// pin copies name, the remote copy of a file stored under its path as of mod,
+// to the version snapshots refer to it by, if any, before it is overwritten
+// or deleted. Until the snapshots are read, all remote copies are pinned.
+func (sy *syncer) pin(ctx context.Context, name string, mod time.Time) error {
+	v := versions.Name(sy.cfg.VersionsPrefix, name, mod)
+	if sy.pinned != nil && !sy.pinned[v] {
+		return nil
+	}
+	if *dryRun {
+		log.Printf("dry run: keeping %s as %s for snapshots", name, v)
+		return nil
+	}
+	if err := sy.copyOnce(ctx, name, v); err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyOnce copies src to dst, unless dst exists, as copied by an earlier run
+// which did not save the manifest.
+func (sy *syncer) copyOnce(ctx context.Context, src, dst string) error {
+	if _, err := sy.s.Stat(ctx, dst); !storage.IsNotExist(err) {
+		return err
+	}
+	return sy.s.Copy(ctx, src, dst)
+}
+
+// release deletes the objects with the given names which neither the manifest
+// nor any snapshot refers to, as files stored by content may share them. It
+// returns the names it could not delete, all of them until the snapshots are
+// read.
+func (sy *syncer) release(ctx context.Context, names []string) map[string]bool {
+	failed := make(map[string]bool)
+	if sy.pinned == nil {
+		log.Printf("Not deleting %v until the snapshots are read", names)
+		for _, name := range names {
+			failed[name] = true
+		}
+		return failed
+	}
+	used := make(map[string]bool)
+	for name := range sy.pinned {
+		used[name] = true
+	}
+	for _, e := range sy.m.Entries() {
+		used[e.Object] = true
+		if e.Stored != nil {
+			used[e.Stored.Name] = true
+		}
+		for _, v := range e.Versions {
+			used[v.Name] = true
+		}
+		// Pending files may be about to use an existing object.
+		if e.Pending && sy.cfg.Layout == config.LayoutContent {
+			used[remote.Blob(sy.enc, sy.cfg.BlobsPrefix, e.Hash)] = true
+		}
+	}
+	for _, name := range names {
+		if used[name] {
+			continue
+		}
+		if *dryRun {
+			log.Printf("dry run: deleting %s", name)
+			continue
+		}
+		if err := sy.s.Delete(ctx, name); err != nil && !storage.IsNotExist(err) {
+			log.Printf("Could not delete %q: %v", name, err)
+			failed[name] = true
+		}
+	}
+	return failed
+}
+
+// finishCycle saves the manifest after syncing, and uploads it if changed.
+func (sy *syncer) finishCycle(ctx context.Context) {
+	if sy.remoteStale {
+		var buf bytes.Buffer
+		if err := sy.m.Dump(&buf); err != nil {
+			log.Printf("Could not dump manifest to buffer: %v", err)
+			return
+		}
+		if err := uploadContent(ctx, sy.s, sy.enc, sy.cfg.RemoteManifestFile, buf.Bytes()); err != nil {
+			log.Printf("Could not upload %q to %q: %v", sy.cfg.ManifestFile, sy.cfg.RemoteManifestFile, err)
+		} else {
+			sy.remoteStale = false
+		}
+	}
+	if err := saveManifest(sy.m, sy.cfg.ManifestFile); err != nil {
+		log.Printf("Could not save manifest to %q: %v", sy.cfg.ManifestFile, err)
+	}
+	sy.snapshot(ctx)
+	if pending := sy.m.Pending(); len(pending) > 0 {
+		log.Printf("%d files not uploaded yet: %v", len(pending), pending)
+	}
+}
+
+// readSnapshots reads the snapshots recorded so far, to know which objects
+// they pin, unless already read.
+func (sy *syncer) readSnapshots(ctx context.Context) {
+	if sy.pinned != nil {
+		return
+	}
+	prefix := sy.cfg.SnapshotsPrefix
+	times, err := snapshot.List(ctx, sy.s, prefix)
+	if err != nil {
+		log.Printf("Could not list snapshots under %q, will retry: %v", prefix, err)
+		return
+	}
+	pinned := make(map[string]bool)
+	for _, t := range times {
+		snap, err := snapshot.Read(ctx, sy.s, sy.enc, prefix, t)
+		if err != nil {
+			log.Printf("Could not read snapshot %s, will retry: %v", snapshot.Name(prefix, t), err)
+			return
+		}
+		for _, f := range snap.Files {
+			pinned[snapshot.Pinned(f, sy.cfg.VersionsPrefix)] = true
+		}
+	}
+	if len(times) > 0 {
+		sy.lastSnapshot = times[len(times)-1]
+	}
+	sy.pinned = pinned
+}
+
+// snapshot records a snapshot of the synced files, if one is due.
+func (sy *syncer) snapshot(ctx context.Context) {
+	interval := sy.cfg.SnapshotInterval.Duration
+	if interval <= 0 || sy.pinned == nil || time.Since(sy.lastSnapshot) < interval {
+		return
+	}
+	snap := snapshot.New(time.Now(), sy.m.Entries(), remote.Dirs(sy.cfg.Dirs))
+	name := snapshot.Name(sy.cfg.SnapshotsPrefix, snap.Time)
+	if *dryRun {
+		log.Printf("dry run: recording snapshot %s of %d files", name, len(snap.Files))
+	} else if err := snapshot.Write(ctx, sy.s, sy.enc, sy.cfg.SnapshotsPrefix, snap); err != nil {
+		log.Printf("Could not record snapshot %s, will retry: %v", name, err)
+		return
+	} else {
+		log.Printf("Recorded snapshot %s of %d files", name, len(snap.Files))
+		for _, f := range snap.Files {
+			sy.pinned[snapshot.Pinned(f, sy.cfg.VersionsPrefix)] = true
+		}
+	}
+	sy.lastSnapshot = snap.Time
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/config"
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/snapshot"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+	"github.com/andreich/docsync/uploader"
+	"github.com/andreich/docsync/versions"
+)
+
+var mod = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testSyncer syncs a temporary directory to storage in memory.
+type testSyncer struct {
+	*syncer
+	t    *testing.T
+	dir  string
+	mem  *storagetest.Memory
+	puts *countingStorage
+}
+
+// countingStorage counts the calls to Put by object.
+type countingStorage struct {
+	*storagetest.Memory
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *countingStorage) Put(ctx context.Context, name string, r io.Reader, opts *storage.PutOptions) error {
+	c.mu.Lock()
+	c.calls[name]++
+	c.mu.Unlock()
+	return c.Memory.Put(ctx, name, r, opts)
+}
+
+func newTestSyncer(t *testing.T, cfg *config.Sync) (*testSyncer, func()) {
+	oldDryRun := *dryRun
+	*dryRun = false
+	dir, err := ioutil.TempDir("", "docsync")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	enc, err := crypt.New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("crypt.New() failed: %v", err)
+	}
+	cfg.Dirs = map[string]string{dir: "docs"}
+	cfg.BlobsPrefix = config.DefaultBlobsPrefix
+	cfg.TrashPrefix = config.DefaultTrashPrefix
+	cfg.VersionsPrefix = versions.DefaultPrefix
+	cfg.SnapshotsPrefix = config.DefaultSnapshotsPrefix
+	mem := storagetest.NewMemory()
+	puts := &countingStorage{Memory: mem, calls: make(map[string]int)}
+	sy := &syncer{
+		s:     puts,
+		enc:   enc,
+		m:     manifest.New(nil, nil),
+		cfg:   cfg,
+		retry: &storage.RetryPolicy{Attempts: 1},
+	}
+	sy.pool = uploader.New(2, time.Minute, 1<<20, sy.upload)
+	return &testSyncer{syncer: sy, t: t, dir: dir, mem: mem, puts: puts}, func() {
+		*dryRun = oldDryRun
+		os.RemoveAll(dir)
+	}
+}
+
+// write writes the local file fn, modified at mod plus the given minutes.
+func (ts *testSyncer) write(fn, contents string, minutes int) {
+	path := filepath.Join(ts.dir, fn)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		ts.t.Fatalf("WriteFile(%q) failed: %v", path, err)
+	}
+	t := mod.Add(time.Duration(minutes) * time.Minute)
+	if err := os.Chtimes(path, t, t); err != nil {
+		ts.t.Fatalf("Chtimes(%q) failed: %v", path, err)
+	}
+}
+
+func (ts *testSyncer) rename(from, to string) {
+	if err := os.Rename(filepath.Join(ts.dir, from), filepath.Join(ts.dir, to)); err != nil {
+		ts.t.Fatalf("Rename(%q, %q) failed: %v", from, to, err)
+	}
+}
+
+func (ts *testSyncer) remove(fn string) {
+	if err := os.Remove(filepath.Join(ts.dir, fn)); err != nil {
+		ts.t.Fatalf("Remove(%q) failed: %v", fn, err)
+	}
+}
+
+func (ts *testSyncer) sync() {
+	if _, err := ts.syncDir(context.Background(), ts.dir, "docs", ts.dir); err != nil {
+		ts.t.Fatalf("syncDir() failed: %v", err)
+	}
+	if pending := ts.m.Pending(); len(pending) > 0 {
+		ts.t.Fatalf("syncDir() left %v pending", pending)
+	}
+}
+
+// read returns the decrypted contents of the object name.
+func (ts *testSyncer) read(name string) (string, error) {
+	data, err := ts.mem.Download(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	data, err = ts.enc.Decrypt(data)
+	return string(data), err
+}
+
+// objects returns the decrypted contents of the objects under prefix.
+func (ts *testSyncer) objects(prefix string) map[string]string {
+	names, err := ts.mem.List(context.Background(), prefix)
+	if err != nil {
+		ts.t.Fatalf("List(%q) failed: %v", prefix, err)
+	}
+	res := make(map[string]string)
+	for _, name := range names {
+		if res[name], err = ts.read(name); err != nil {
+			ts.t.Fatalf("reading %q failed: %v", name, err)
+		}
+	}
+	return res
+}
+
+// contents returns the contents of the objects under prefix.
+func (ts *testSyncer) contents(prefix string) []string {
+	var res []string
+	for _, c := range ts.objects(prefix) {
+		res = append(res, c)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func hashOf(contents string) [md5.Size]byte {
+	return md5.Sum([]byte(contents))
+}
+
+// takeSnapshot records a snapshot, returning it as read back.
+func (ts *testSyncer) takeSnapshot() *snapshot.Snapshot {
+	ctx := context.Background()
+	ts.cfg.SnapshotInterval.Duration = time.Hour
+	ts.lastSnapshot = time.Time{}
+	ts.snapshot(ctx)
+	times, err := snapshot.List(ctx, ts.mem, ts.cfg.SnapshotsPrefix)
+	if err != nil || len(times) != 1 {
+		ts.t.Fatalf("snapshot.List() want 1 snapshot, got (%v, %v)", times, err)
+	}
+	snap, err := snapshot.Read(ctx, ts.mem, ts.enc, ts.cfg.SnapshotsPrefix, times[0])
+	if err != nil {
+		ts.t.Fatalf("snapshot.Read() failed: %v", err)
+	}
+	return snap
+}
+
+// checkSnapshot checks that the files of snap can be restored with the given
+// contents, by path relative to the synced directory.
+func (ts *testSyncer) checkSnapshot(snap *snapshot.Snapshot, want map[string]string) {
+	got := make(map[string]string)
+	for _, f := range snap.Files {
+		name := snapshot.Locate(f, ts.m, ts.cfg.VersionsPrefix)
+		contents, err := ts.read(name)
+		if err != nil {
+			ts.t.Errorf("reading %q, located for %q, failed: %v", name, f.Path, err)
+		}
+		got[strings.TrimPrefix(f.Path, ts.dir+"/")] = contents
+	}
+	if !reflect.DeepEqual(got, want) {
+		ts.t.Errorf("snapshot restores %v, want %v", got, want)
+	}
+}
+
+func TestSyncContent(t *testing.T) {
+	ts, cleanup := newTestSyncer(t, &config.Sync{
+		Layout:   config.LayoutContent,
+		OnDelete: config.OnDeleteDelete,
+		Versions: versions.Policy{Keep: 1},
+	})
+	defer cleanup()
+
+	ts.write("a", "one", 0)
+	ts.write("b", "one", 0)
+	ts.write("c", "other", 0)
+	ts.sync()
+	if got, want := ts.contents("blobs/"), []string{"one", "other"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("blobs after sync want %v, got %v", want, got)
+	}
+	snap := ts.takeSnapshot()
+
+	// Shared blobs are kept while used.
+	ts.remove("a")
+	ts.rename("c", "d")
+	ts.sync()
+	if got, want := ts.contents("blobs/"), []string{"one", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blobs after remove and rename want %v, got %v", want, got)
+	}
+	if e, _ := ts.m.Lookup(filepath.Join(ts.dir, "d")); e.Object != remote.Blob(ts.enc, "blobs/", e.Hash) {
+		t.Errorf("renamed file want the blob of its contents, got %+v", e)
+	}
+
+	// Expired versions are deleted, unless a snapshot refers to them.
+	for i, contents := range []string{"two", "three", "four"} {
+		ts.write("b", contents, i+1)
+		ts.sync()
+	}
+	if got, want := ts.contents("blobs/"), []string{"four", "one", "other", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blobs after modifications want %v, got %v", want, got)
+	}
+	e, _ := ts.m.Lookup(filepath.Join(ts.dir, "b"))
+	if len(e.Versions) != 1 || e.Versions[0].Hash != hashOf("three") {
+		t.Errorf("versions of b want the third contents, got %+v", e.Versions)
+	}
+	ts.checkSnapshot(snap, map[string]string{"a": "one", "b": "one", "c": "other"})
+
+	// Until the snapshots are read, nothing is deleted.
+	ts.pinned = nil
+	name := remote.Blob(ts.enc, "blobs/", hashOf("three"))
+	if failed := ts.release(context.Background(), []string{name}); !failed[name] {
+		t.Errorf("release() before reading snapshots want %q failed, got %v", name, failed)
+	}
+	ts.readSnapshots(context.Background())
+	ts.m.SetVersions(filepath.Join(ts.dir, "b"), nil)
+	if failed := ts.release(context.Background(), []string{name}); len(failed) > 0 {
+		t.Errorf("release() want no failures, got %v", failed)
+	}
+	if _, err := ts.mem.Stat(context.Background(), name); !storage.IsNotExist(err) {
+		t.Errorf("Stat() of released %q want %v, got %v", name, storage.ErrNotExist, err)
+	}
+}
+
+func TestSyncSameContents(t *testing.T) {
+	ts, cleanup := newTestSyncer(t, &config.Sync{Layout: config.LayoutContent})
+	defer cleanup()
+
+	ts.write("a", "same", 0)
+	ts.write("b", "same", 0)
+	ts.write("c", "same", 0)
+	ts.sync()
+	name := remote.Blob(ts.enc, "blobs/", hashOf("same"))
+	if got := ts.puts.calls[name]; got != 1 {
+		t.Errorf("Put(%q) want 1 call, got %d", name, got)
+	}
+	for _, fn := range []string{"a", "b", "c"} {
+		if e, _ := ts.m.Lookup(filepath.Join(ts.dir, fn)); e.Object != name || e.Pending {
+			t.Errorf("%s want committed to %q, got %+v", fn, name, e)
+		}
+	}
+	if got, want := ts.contents("blobs/"), []string{"same"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blobs want %v, got %v", want, got)
+	}
+}
+
+func TestSyncPath(t *testing.T) {
+	ts, cleanup := newTestSyncer(t, &config.Sync{
+		Layout:   config.LayoutPath,
+		OnDelete: config.OnDeleteDelete,
+	})
+	defer cleanup()
+
+	ts.write("a", "one", 0)
+	ts.write("b", "two", 0)
+	ts.write("c", "three", 0)
+	ts.write("d", "four", 0)
+	ts.sync()
+	snap := ts.takeSnapshot()
+
+	ts.write("a", "modified", 1)
+	ts.rename("b", "renamed")
+	ts.remove("c")
+	ts.sync()
+	want := map[string]string{"docs/a": "modified", "docs/d": "four", "docs/renamed": "two"}
+	if got := ts.objects("docs/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("objects after changes want %v, got %v", want, got)
+	}
+	// Without versions, only the remote copies in the snapshot are kept.
+	if got, want := ts.contents("versions/"), []string{"one", "three", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions want %v, got %v", want, got)
+	}
+	ts.checkSnapshot(snap, map[string]string{"a": "one", "b": "two", "c": "three", "d": "four"})
+
+	// Modified again, the copy in no snapshot is not kept.
+	ts.write("a", "again", 2)
+	ts.sync()
+	if got, want := ts.contents("versions/"), []string{"one", "three", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions after modifying again want %v, got %v", want, got)
+	}
+}
+
+func TestKeepVersion(t *testing.T) {
+	ts, cleanup := newTestSyncer(t, &config.Sync{
+		Layout:   config.LayoutPath,
+		Versions: versions.Policy{Keep: 2},
+	})
+	defer cleanup()
+
+	for i, contents := range []string{"one", "two", "three", "four"} {
+		ts.write("a", contents, i)
+		ts.sync()
+	}
+	if got, want := ts.contents("versions/"), []string{"three", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions want %v, got %v", want, got)
+	}
+	e, _ := ts.m.Lookup(filepath.Join(ts.dir, "a"))
+	var names []string
+	for _, v := range e.Versions {
+		names = append(names, v.Name)
+	}
+	want := []string{
+		versions.Name("versions/", "docs/a", mod.Add(time.Minute)),
+		versions.Name("versions/", "docs/a", mod.Add(2*time.Minute)),
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("versions in the manifest want %v, got %v", want, names)
+	}
+}
+
+func TestUploadMemory(t *testing.T) {
+	for _, test := range []struct {
+		storageType string
+		size        int64
+		want        int64
+	}{
+		{config.StorageLocal, 1 << 30, crypt.ChunkSize},
+		{config.StorageGCS, 1000, crypt.ChunkSize + 1000},
+		{config.StorageGCS, 1 << 30, crypt.ChunkSize + 16<<20},
+		{config.StorageS3, 1000, crypt.ChunkSize + 1000},
+		{config.StorageS3, 1 << 30, crypt.ChunkSize + 32<<20},
+	} {
+		cfg := &config.Sync{}
+		cfg.Type = test.storageType
+		sy := &syncer{cfg: cfg}
+		if got := sy.uploadMemory(test.size); got != test.want {
+			t.Errorf("uploadMemory(%d) with %s storage want %d, got %d", test.size, test.storageType, test.want, got)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	ts, cleanup := newTestSyncer(t, &config.Sync{})
+	defer cleanup()
+	ts.cfg.ManifestFile = filepath.Join(ts.dir, "manifest")
+	ts.cfg.RemoteManifestFile = "manifest"
+	ctx := context.Background()
+
+	saveLocal := func() {
+		if err := manifest.Save(manifest.New(nil, nil), ts.cfg.ManifestFile); err != nil {
+			t.Fatalf("Save() failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	saveRemote := func() {
+		var buf bytes.Buffer
+		if err := manifest.New(nil, nil).Dump(&buf); err != nil {
+			t.Fatalf("Dump() failed: %v", err)
+		}
+		if err := uploadContent(ctx, ts.s, ts.enc, ts.cfg.RemoteManifestFile, buf.Bytes()); err != nil {
+			t.Fatalf("uploadContent() failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	load := func() bool {
+		_, remoteStale, err := loadManifest(ctx, ts.s, ts.enc, ts.cfg)
+		if err != nil {
+			t.Fatalf("loadManifest() failed: %v", err)
+		}
+		return remoteStale
+	}
+
+	// The remote manifest is missing.
+	if !load() {
+		t.Errorf("loadManifest() without manifests want remote stale")
+	}
+	saveLocal()
+	if !load() {
+		t.Errorf("loadManifest() without remote manifest want remote stale")
+	}
+	saveRemote()
+	if load() {
+		t.Errorf("loadManifest() with newer remote manifest want remote up to date")
+	}
+	saveLocal()
+	if !load() {
+		t.Errorf("loadManifest() with newer local manifest want remote stale")
+	}
+	// The local manifest is used if the remote one can't be decrypted.
+	if err := store(ctx, ts.s, ts.cfg.RemoteManifestFile, []byte("not encrypted")); err != nil {
+		t.Fatalf("store() failed: %v", err)
+	}
+	if !load() {
+		t.Errorf("loadManifest() with undecryptable remote manifest want remote stale")
+	}
+}
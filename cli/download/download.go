@@ -2,14 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 
 	"github.com/andreich/docsync/config"
 	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/remote"
 	"github.com/andreich/docsync/storage"
 )
 
@@ -35,30 +34,19 @@ func main() {
 		log.Fatalf("Could not parse config from %q: %v", *configFile, err)
 	}
 
-	enc, err := crypt.New(cfg.AESPassphrase)
+	enc, err := crypt.New(cfg.AESPassphrase, crypt.WithLegacyCBC(cfg.LegacyCBC()))
 	if err != nil {
 		log.Fatalf("Could not create decryption: %v", err)
 	}
 	log.Printf("Downloading %q to %q", *filename, *destination)
 
 	ctx := context.Background()
-	creds, err := json.Marshal(cfg.Credentials)
-	if err != nil {
-		log.Fatalf("Could not serialize credentials: %v", err)
-	}
-	s, err := storage.New(ctx, cfg.BucketName, creds)
+	s, err := storage.FromConfig(ctx, &cfg.Storage)
 	if err != nil {
 		log.Fatalf("Could not initialize storage: %v", err)
 	}
-	if data, err := s.Download(ctx, *filename); err != nil {
-		log.Fatalf("Could not download %q: %v", *filename, err)
-	} else {
-		bytes, err := enc.Decrypt(data)
-		if err != nil {
-			log.Fatalf("Decryption failed: %v", err)
-		}
-		if err := ioutil.WriteFile(*destination, bytes, 0600); err != nil {
-			log.Fatalf("Could not write bytes to %q: %v", *destination, err)
-		}
+	s = storage.WithRetry(s, storage.DefaultRetryPolicy())
+	if err := remote.Download(ctx, s, enc, *filename, *destination); err != nil {
+		log.Fatalf("Could not download %q to %q: %v", *filename, *destination, err)
 	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andreich/docsync/remote"
+)
+
+var (
+	configFile = flag.String("config", "$HOME/.docsync/config.json", "The configuration file to read.")
+	prefix     = flag.String("prefix", "", "Only list the files in storage starting with this prefix.")
+	format     = flag.String("format", "short", "How to list the files: short (names only), long, tree or json.")
+)
+
+// jsonObject is the JSON output for a remote.Object.
+type jsonObject struct {
+	Name    string     `json:"name"`
+	Path    string     `json:"path,omitempty"`
+	Size    *int64     `json:"size,omitempty"`
+	Mod     *time.Time `json:"mod_time,omitempty"`
+	MD5     string     `json:"md5,omitempty"`
+	Pending bool       `json:"pending,omitempty"`
+}
+
+func printJSON(w io.Writer, objs []remote.Object) error {
+	res := []jsonObject{}
+	for _, obj := range objs {
+		o := jsonObject{Name: obj.Name}
+		if e := obj.Entry; e != nil {
+			o.Path = e.Path
+			o.Size = &e.Size
+			o.Mod = &e.Mod
+			o.MD5 = hex.EncodeToString(e.Hash[:])
+			o.Pending = e.Pending
+		}
+		res = append(res, o)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+func printLong(w io.Writer, objs []remote.Object) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, obj := range objs {
+		e := obj.Entry
+		if e == nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\n", obj.Name)
+			continue
+		}
+		path := e.Path
+		if e.Pending {
+			path += " (pending)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%x\t%s\n", obj.Name, e.Size, e.Mod.Format(time.RFC3339), e.Hash, path)
+	}
+	return tw.Flush()
+}
+
+// printTree prints the names indented by directory, with the directories
+// ending in a slash.
+func printTree(w io.Writer, objs []remote.Object) error {
+	var prev []string
+	for _, obj := range objs {
+		parts := strings.Split(obj.Name, "/")
+		common := 0
+		for common < len(prev)-1 && common < len(parts)-1 && prev[common] == parts[common] {
+			common++
+		}
+		for i := common; i < len(parts); i++ {
+			name := parts[i]
+			if i < len(parts)-1 {
+				name += "/"
+			} else if obj.Entry != nil {
+				name += fmt.Sprintf(" (%d bytes, %s)", obj.Entry.Size, obj.Entry.Mod.Format(time.RFC3339))
+			}
+			if _, err := fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", i), name); err != nil {
+				return err
+			}
+		}
+		prev = parts
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	*configFile = os.ExpandEnv(*configFile)
+
+	printer := map[string]func(io.Writer, []remote.Object) error{
+		"long": printLong,
+		"tree": printTree,
+		"json": printJSON,
+		"short": func(w io.Writer, objs []remote.Object) error {
+			for _, obj := range objs {
+				if _, err := fmt.Fprintln(w, obj.Name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}[*format]
+	if printer == nil {
+		log.Fatalf("Unknown --format %q", *format)
+	}
+
+	ctx := context.Background()
+	b, err := remote.Open(ctx, *configFile)
+	if err != nil {
+		log.Fatalf("Could not open the bucket: %v", err)
+	}
+	cfg, s := b.Config, b.Storage
+
+	names, err := s.List(ctx, *prefix)
+	if err != nil {
+		log.Fatalf("Could not list %q: %v", *prefix, err)
+	}
+	m, err := b.Manifest(ctx)
+	if err != nil {
+		log.Fatalf("Could not load remote manifest %q: %v", cfg.RemoteManifestFile, err)
+	}
+	if err := printer(os.Stdout, remote.Join(names, m.Entries(), cfg.Dirs)); err != nil {
+		log.Fatalf("Could not print the listing: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+)
+
+var (
+	configFile = flag.String("config", "$HOME/.docsync/config.json", "The configuration file to read.")
+	file       = flag.String("file", "", "Read or write this local manifest file, like manifest_file, instead of the remote manifest. The configuration is not needed then.")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] command
+
+Commands:
+  export         write the manifest to standard output, as JSON lines
+  import FILE    replace the manifest with the one in FILE, or standard input
+                 for -, as JSON lines or saved by older versions of docsync
+
+docsync should not be running while importing a manifest, as it would
+overwrite it.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// bucket returns the bucket holding the remote manifest.
+func bucket(ctx context.Context) *remote.Bucket {
+	b, err := remote.Open(ctx, os.ExpandEnv(*configFile))
+	if err != nil {
+		log.Fatalf("Could not open the bucket: %v", err)
+	}
+	return b
+}
+
+func export(ctx context.Context) {
+	var m manifest.Manifest
+	var err error
+	if *file != "" {
+		m, err = manifest.Open(*file, nil, nil)
+	} else {
+		m, err = bucket(ctx).Manifest(ctx)
+	}
+	if err != nil {
+		log.Fatalf("Could not load the manifest: %v", err)
+	}
+	log.Printf("Exporting %d files, saved at %v", len(m.Entries()), m.Saved())
+	if err := m.Dump(os.Stdout); err != nil {
+		log.Fatalf("Could not export the manifest: %v", err)
+	}
+}
+
+func load(fn string) manifest.Manifest {
+	var r io.Reader = os.Stdin
+	if fn != "-" {
+		f, err := os.Open(fn)
+		if err != nil {
+			log.Fatalf("Could not open %q: %v", fn, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	m := manifest.New(nil, nil)
+	if err := m.Load(r); err != nil {
+		log.Fatalf("Could not load the manifest from %q: %v", fn, err)
+	}
+	return m
+}
+
+func importFrom(ctx context.Context, fn string) {
+	m := load(fn)
+	if *file != "" {
+		if err := manifest.Save(m, *file); err != nil {
+			log.Fatalf("Could not save the manifest to %q: %v", *file, err)
+		}
+		log.Printf("Imported %d files to %q", len(m.Entries()), *file)
+		return
+	}
+	b := bucket(ctx)
+	cfg, s := b.Config, b.Storage
+	params, err := crypt.LoadOrCreateParams(ctx, s, cfg.KDFParamsFile)
+	if err != nil {
+		log.Fatalf("Could not load key derivation parameters from %q: %v", cfg.KDFParamsFile, err)
+	}
+	enc, err := crypt.New(cfg.AESPassphrase, crypt.WithParams(params), crypt.WithCompression(cfg.Compress), crypt.WithLegacyCBC(cfg.LegacyCBC()))
+	if err != nil {
+		log.Fatalf("Could not create encryption: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		log.Fatalf("Could not dump the manifest: %v", err)
+	}
+	data, err := enc.Encrypt(buf.Bytes())
+	if err != nil {
+		log.Fatalf("Could not encrypt the manifest: %v", err)
+	}
+	if err := s.Upload(ctx, cfg.RemoteManifestFile, data); err != nil {
+		log.Fatalf("Could not upload the manifest to %q: %v", cfg.RemoteManifestFile, err)
+	}
+	log.Printf("Imported %d files to %q", len(m.Entries()), cfg.RemoteManifestFile)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	ctx := context.Background()
+	switch args := flag.Args(); {
+	case len(args) == 1 && args[0] == "export":
+		export(ctx)
+	case len(args) == 2 && args[0] == "import":
+		importFrom(ctx, args[1])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
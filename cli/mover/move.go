@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/andreich/docsync/mover"
+	"github.com/andreich/docsync/signals"
 )
 
 var (
@@ -17,6 +18,7 @@ var (
 
 func main() {
 	flag.Parse()
+	ctx, scanNow := signals.Handle()
 	*configFile = os.ExpandEnv(*configFile)
 	log.Printf("Started with config: %s", *configFile)
 
@@ -32,6 +34,13 @@ func main() {
 			log.Fatal(err)
 		}
 		log.Printf("Sleeping %v", *interval)
-		time.Sleep(*interval)
+		select {
+		case <-ctx.Done():
+			log.Printf("Shut down")
+			return
+		case <-scanNow:
+			log.Printf("Received SIGUSR1, scanning now")
+		case <-time.After(*interval):
+		}
 	}
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/andreich/docsync/remote"
+)
+
+var (
+	configFile = flag.String("config", "$HOME/.docsync/config.json", "The configuration file to read.")
+	dir        = flag.String("dir", "", "Only restore the files within this local directory.")
+	match      = flag.String("match", "", "Only restore the files whose local path matches this regexp.")
+	target     = flag.String("target", "", "Restore the files under this directory, instead of where they were synced from.")
+	parallel   = flag.Int("parallel", 4, "How many files to download at once.")
+	dryRun     = flag.Bool("dry_run", false, "Only print the files which would be restored.")
+	force      = flag.Bool("force", false, "Overwrite the local files with other contents than restored, which are otherwise kept. Implied by -target.")
+)
+
+func main() {
+	flag.Parse()
+	*configFile = os.ExpandEnv(*configFile)
+
+	var re *regexp.Regexp
+	if *match != "" {
+		var err error
+		if re, err = regexp.Compile(*match); err != nil {
+			log.Fatalf("Invalid --match: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	b, err := remote.Open(ctx, *configFile)
+	if err != nil {
+		log.Fatalf("Could not open the bucket: %v", err)
+	}
+	cfg, s, enc := b.Config, b.Storage, b.Enc
+
+	m, err := b.Manifest(ctx)
+	if err != nil {
+		log.Fatalf("Could not load remote manifest %q: %v", cfg.RemoteManifestFile, err)
+	}
+
+	dirs := remote.Dirs(cfg.Dirs)
+	prefix := strings.TrimSuffix(filepath.Clean(*dir), "/") + "/"
+	var files []remote.File
+	for _, e := range m.Entries() {
+		if *dir != "" && !strings.HasPrefix(e.Path, prefix) {
+			continue
+		}
+		if re != nil && !re.MatchString(e.Path) {
+			continue
+		}
+		v, found := dirs.Stored(e)
+		if !found {
+			log.Printf("Skipping %q, not uploaded or not within the configured dirs", e.Path)
+			continue
+		}
+		if e.Pending {
+			log.Printf("%q was not uploaded since it last changed, restoring an older version", e.Path)
+		}
+		local := e.Path
+		if *target != "" {
+			local = filepath.Join(*target, e.Path)
+		}
+		if *dryRun {
+			log.Printf("dry run: restoring %s to %s", v.Name, local)
+			continue
+		}
+		files = append(files, remote.File{
+			Name:      v.Name,
+			Local:     local,
+			Mod:       v.Mod,
+			Hash:      v.Hash,
+			Overwrite: *force || *target != "",
+		})
+	}
+
+	counts := make(map[remote.Status]int)
+	remote.Restore(ctx, s, enc, files, *parallel, func(f remote.File, status remote.Status, err error) {
+		counts[status]++
+		if err != nil {
+			log.Printf("Could not restore %q to %q: %v", f.Name, f.Local, err)
+		} else if status == remote.Differing {
+			log.Printf("Not overwriting %q, which differs from %q; use -force to overwrite it", f.Local, f.Name)
+		}
+	})
+	log.Printf("Restored %d files, skipped %d already present, %d differing, %d failed", counts[remote.Restored], counts[remote.Skipped], counts[remote.Differing], counts[remote.Failed])
+	if counts[remote.Failed] > 0 {
+		os.Exit(1)
+	}
+}
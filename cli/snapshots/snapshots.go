@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/snapshot"
+)
+
+var (
+	configFile = flag.String("config", "$HOME/.docsync/config.json", "The configuration file to read.")
+	dir        = flag.String("dir", "", "restore: only restore the files within this local directory.")
+	target     = flag.String("target", "", "restore: restore the files under this directory, instead of where they were synced from.")
+	parallel   = flag.Int("parallel", 4, "restore: how many files to download at once.")
+	dryRun     = flag.Bool("dry_run", false, "restore: only print the files which would be restored.")
+	force      = flag.Bool("force", false, "restore: overwrite the local files with other contents than restored, which are otherwise kept. Implied by -target.")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] command
+
+Commands:
+  list           list the snapshots
+  diff FROM [TO] list the files changed between the snapshots at FROM and TO,
+                 by default the latest
+  restore AT     restore the files as of the snapshot at AT
+
+Snapshots are selected by time, either as a day like 2021-03-01, for the last
+snapshot of the day, or as listed, for the last snapshot at or before that time.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// parseTime parses the time of the snapshot to select.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// find returns the time of the snapshot selected by s.
+func find(times []time.Time, s string) time.Time {
+	at, err := parseTime(s)
+	if err != nil {
+		log.Fatalf("Invalid snapshot time %q: %v", s, err)
+	}
+	t, found := snapshot.Find(times, at)
+	if !found {
+		log.Fatalf("No snapshot at or before %v", at)
+	}
+	return t
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	*configFile = os.ExpandEnv(*configFile)
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	b, err := remote.Open(ctx, *configFile)
+	if err != nil {
+		log.Fatalf("Could not open the bucket: %v", err)
+	}
+	cfg, s, enc := b.Config, b.Storage, b.Enc
+
+	times, err := snapshot.List(ctx, s, cfg.SnapshotsPrefix)
+	if err != nil {
+		log.Fatalf("Could not list snapshots under %q: %v", cfg.SnapshotsPrefix, err)
+	}
+	read := func(t time.Time) *snapshot.Snapshot {
+		snap, err := snapshot.Read(ctx, s, enc, cfg.SnapshotsPrefix, t)
+		if err != nil {
+			log.Fatalf("Could not read snapshot %s: %v", snapshot.Name(cfg.SnapshotsPrefix, t), err)
+		}
+		return snap
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, t := range times {
+			snap := read(t)
+			var size int64
+			for _, f := range snap.Files {
+				size += f.Size
+			}
+			fmt.Printf("%s\t%d files\t%d bytes\n", t.Format(time.RFC3339), len(snap.Files), size)
+		}
+	case args[0] == "diff" && (len(args) == 2 || len(args) == 3):
+		if len(times) == 0 {
+			log.Fatalf("No snapshots under %q", cfg.SnapshotsPrefix)
+		}
+		to := times[len(times)-1]
+		if len(args) == 3 {
+			to = find(times, args[2])
+		}
+		for _, c := range snapshot.Diff(read(find(times, args[1])), read(to)) {
+			if c.Kind == manifest.Renamed {
+				fmt.Printf("%s\t%s\t(from %s)\n", c.Kind, c.Path, c.From)
+				continue
+			}
+			fmt.Printf("%s\t%s\n", c.Kind, c.Path)
+		}
+	case args[0] == "restore" && len(args) == 2:
+		restore(ctx, b, read(find(times, args[1])))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func restore(ctx context.Context, b *remote.Bucket, snap *snapshot.Snapshot) {
+	m, err := b.Manifest(ctx)
+	if err != nil {
+		log.Fatalf("Could not load remote manifest %q: %v", b.Config.RemoteManifestFile, err)
+	}
+	log.Printf("Restoring snapshot of %s", snap.Time.Format(time.RFC3339))
+
+	prefix := strings.TrimSuffix(filepath.Clean(*dir), "/") + "/"
+	var files []remote.File
+	for _, f := range snap.Files {
+		if *dir != "" && !strings.HasPrefix(f.Path, prefix) {
+			continue
+		}
+		name := snapshot.Locate(f, m, b.Config.VersionsPrefix)
+		local := f.Path
+		if *target != "" {
+			local = filepath.Join(*target, f.Path)
+		}
+		if *dryRun {
+			log.Printf("dry run: restoring %s to %s", name, local)
+			continue
+		}
+		files = append(files, remote.File{
+			Name:      name,
+			Local:     local,
+			Mod:       f.Mod,
+			Hash:      f.Hash,
+			Overwrite: *force || *target != "",
+		})
+	}
+
+	counts := make(map[remote.Status]int)
+	remote.Restore(ctx, b.Storage, b.Enc, files, *parallel, func(f remote.File, status remote.Status, err error) {
+		counts[status]++
+		if err != nil {
+			log.Printf("Could not restore %q to %q: %v", f.Name, f.Local, err)
+		} else if status == remote.Differing {
+			log.Printf("Not overwriting %q, which differs from %q; use -force to overwrite it", f.Local, f.Name)
+		}
+	})
+	log.Printf("Restored %d files, skipped %d already present, %d differing, %d failed", counts[remote.Restored], counts[remote.Skipped], counts[remote.Differing], counts[remote.Failed])
+	if counts[remote.Failed] > 0 {
+		os.Exit(1)
+	}
+}
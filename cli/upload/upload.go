@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 
@@ -26,34 +24,33 @@ func main() {
 		log.Fatalf("Could not parse config from %q: %v", *configFile, err)
 	}
 
-	bytes, err := ioutil.ReadFile(*filename)
+	f, err := os.Open(*filename)
 	if err != nil {
 		log.Fatalf("Could not read file %q: %v", *filename, err)
 	}
+	defer f.Close()
 
-	enc, err := crypt.New(cfg.AESPassphrase)
-	if err != nil {
-		log.Fatalf("Could not create encryption: %v", err)
-	}
-	log.Printf("Encrypting with passphrase: %q", cfg.AESPassphrase)
-
-	data, err := enc.Encrypt(bytes)
+	ctx := context.Background()
+	s, err := storage.FromConfig(ctx, &cfg.Storage)
 	if err != nil {
-		log.Fatalf("Encryption failed: %v", err)
+		log.Fatalf("Could not initialize storage: %v", err)
 	}
+	s = storage.WithRetry(s, storage.DefaultRetryPolicy())
 
-	log.Printf("Uploading %q (%d bytes)", *filename, len(data))
-
-	ctx := context.Background()
-	creds, err := json.Marshal(cfg.Credentials)
+	params, err := crypt.LoadOrCreateParams(ctx, s, cfg.KDFParamsFile)
 	if err != nil {
-		log.Fatalf("Could not serialize credentials: %v", err)
+		log.Fatalf("Could not load key derivation parameters from %q: %v", cfg.KDFParamsFile, err)
 	}
-	s, err := storage.New(ctx, cfg.BucketName, creds)
+	enc, err := crypt.New(cfg.AESPassphrase, crypt.WithParams(params), crypt.WithCompression(cfg.Compress), crypt.WithLegacyCBC(cfg.LegacyCBC()))
 	if err != nil {
-		log.Fatalf("Could not initialize storage: %v", err)
+		log.Fatalf("Could not create encryption: %v", err)
 	}
-	if err := s.Upload(ctx, *filename, data); err != nil {
+
+	log.Printf("Uploading %q", *filename)
+
+	r := crypt.EncryptReader(enc, f)
+	defer r.Close()
+	if err := s.Put(ctx, *filename, r, nil); err != nil {
 		log.Fatalf("Could not upload %q: %v", *filename, err)
 	}
 }
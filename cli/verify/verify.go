@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/snapshot"
+)
+
+var (
+	configFile = flag.String("config", "$HOME/.docsync/config.json", "The configuration file to read.")
+	sample     = flag.Float64("sample", 0, "The fraction of the files to download and compare with the manifest, from 0 for none to 1 for all.")
+	local      = flag.Bool("local", false, "Also compare the manifest with the local files.")
+	parallel   = flag.Int("parallel", 4, "How many files to download at once.")
+)
+
+func main() {
+	flag.Parse()
+	*configFile = os.ExpandEnv(*configFile)
+
+	if *sample < 0 || *sample > 1 {
+		log.Fatalf("Invalid --sample %v, want from 0 to 1", *sample)
+	}
+
+	ctx := context.Background()
+	b, err := remote.Open(ctx, *configFile)
+	if err != nil {
+		log.Fatalf("Could not open the bucket: %v", err)
+	}
+	cfg, s, enc := b.Config, b.Storage, b.Enc
+
+	names, err := s.List(ctx, "")
+	if err != nil {
+		log.Fatalf("Could not list the files in storage: %v", err)
+	}
+	m, err := b.Manifest(ctx)
+	if err != nil {
+		log.Fatalf("Could not load remote manifest %q: %v", cfg.RemoteManifestFile, err)
+	}
+
+	// The manifest and key derivation parameters are not synced files, even
+	// when stored within a synced directory.
+	var synced []string
+	for _, name := range names {
+		if name != cfg.RemoteManifestFile && name != cfg.KDFParamsFile {
+			synced = append(synced, name)
+		}
+	}
+
+	// The objects snapshots refer to are kept, even when no longer in the
+	// manifest.
+	pinned := make(map[string]bool)
+	times, err := snapshot.List(ctx, s, cfg.SnapshotsPrefix)
+	if err != nil {
+		log.Fatalf("Could not list snapshots under %q: %v", cfg.SnapshotsPrefix, err)
+	}
+	for _, t := range times {
+		snap, err := snapshot.Read(ctx, s, enc, cfg.SnapshotsPrefix, t)
+		if err != nil {
+			log.Fatalf("Could not read snapshot %s: %v", snapshot.Name(cfg.SnapshotsPrefix, t), err)
+		}
+		for _, f := range snap.Files {
+			pinned[f.Name] = true
+		}
+	}
+
+	entries := m.Entries()
+	counts := make(map[remote.Problem]int)
+	problems := 0
+	checked := remote.Verify(ctx, s, enc, synced, entries, remote.Dirs(cfg.Dirs), &remote.VerifyOptions{
+		Sample:   *sample,
+		Local:    *local,
+		Parallel: *parallel,
+		Blobs:    cfg.BlobsPrefix,
+		Ignored:  []string{cfg.TrashPrefix, cfg.VersionsPrefix, cfg.SnapshotsPrefix},
+		Pinned:   pinned,
+	}, func(f remote.Finding) {
+		counts[f.Problem]++
+		// Pending files are uploaded by the next sync.
+		if f.Problem != remote.Pending {
+			problems++
+		}
+		if f.Path != "" {
+			log.Printf("%s %q (%s): %v", f.Problem, f.Name, f.Path, f.Err)
+		} else {
+			log.Printf("%s %q: %v", f.Problem, f.Name, f.Err)
+		}
+	})
+	log.Printf("Verified %d files in the manifest, %d in storage, downloaded %d: %d missing, %d orphaned, %d corrupted, %d stale, %d unchecked, %d pending",
+		len(entries), len(synced), checked, counts[remote.Missing], counts[remote.Orphaned], counts[remote.Corrupted], counts[remote.Stale], counts[remote.Unchecked], counts[remote.Pending])
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
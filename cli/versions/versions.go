@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/storage"
+)
+
+var (
+	configFile = flag.String("config", "$HOME/.docsync/config.json", "The configuration file to read.")
+	file       = flag.String("file", "", "The local file to list the versions of.")
+	version    = flag.String("version", "", "Restore the version of --file modified at this time, as listed.")
+	target     = flag.String("target", "", "Restore the version to this file, instead of --file.")
+)
+
+// versionTime formats the modification time identifying a version.
+func versionTime(mod time.Time) string {
+	return mod.UTC().Format(time.RFC3339Nano)
+}
+
+func list(e manifest.Entry, dirs remote.Dirs) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, v := range e.Versions {
+		fmt.Fprintf(w, "%s\t%d\t%x\t%s\n", versionTime(v.Mod), v.Size, v.Hash, v.Name)
+	}
+	// Pending changes are not in storage yet.
+	v, found := dirs.Stored(e)
+	switch {
+	case !found:
+		fmt.Fprintf(w, "-\t-\t-\t(not uploaded yet)\n")
+	case e.Pending:
+		fmt.Fprintf(w, "%s\t%d\t%x\t%s (current, changed since)\n", versionTime(v.Mod), v.Size, v.Hash, v.Name)
+	default:
+		fmt.Fprintf(w, "%s\t%d\t%x\t%s (current)\n", versionTime(v.Mod), v.Size, v.Hash, v.Name)
+	}
+	return w.Flush()
+}
+
+// restoreVersion restores the version of the file of e modified at version,
+// formatted by versionTime, to local, overwriting it.
+func restoreVersion(ctx context.Context, s storage.Storage, enc crypt.Encryption, e manifest.Entry, version, local string) (remote.Status, error) {
+	var f *remote.File
+	for _, v := range e.Versions {
+		if versionTime(v.Mod) == version {
+			f = &remote.File{Name: v.Name, Local: local, Mod: v.Mod, Hash: v.Hash, Overwrite: true}
+		}
+	}
+	if f == nil {
+		return remote.Failed, errors.New("no such version")
+	}
+	var status remote.Status
+	var err error
+	remote.Restore(ctx, s, enc, []remote.File{*f}, 1, func(_ remote.File, st remote.Status, rerr error) {
+		status, err = st, rerr
+	})
+	return status, err
+}
+
+func main() {
+	flag.Parse()
+	*configFile = os.ExpandEnv(*configFile)
+
+	if *file == "" {
+		log.Fatalf("--file is required")
+	}
+	fn, err := filepath.Abs(*file)
+	if err != nil {
+		log.Fatalf("Invalid --file: %v", err)
+	}
+
+	ctx := context.Background()
+	b, err := remote.Open(ctx, *configFile)
+	if err != nil {
+		log.Fatalf("Could not open the bucket: %v", err)
+	}
+	cfg, s, enc := b.Config, b.Storage, b.Enc
+
+	m, err := b.Manifest(ctx)
+	if err != nil {
+		log.Fatalf("Could not load remote manifest %q: %v", cfg.RemoteManifestFile, err)
+	}
+	e, found := m.Lookup(fn)
+	if !found {
+		log.Fatalf("%q is not in the manifest", fn)
+	}
+
+	if *version == "" {
+		if err := list(e, remote.Dirs(cfg.Dirs)); err != nil {
+			log.Fatalf("Could not list the versions: %v", err)
+		}
+		return
+	}
+
+	local := fn
+	if *target != "" {
+		local = *target
+	}
+	status, err := restoreVersion(ctx, s, enc, e, *version, local)
+	if err != nil {
+		log.Fatalf("Could not restore the version of %q modified at %s: %v", fn, *version, err)
+	}
+	log.Printf("%s the version of %q modified at %s to %q", status, fn, *version, local)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+func TestRestoreVersion(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemory()
+	enc, err := crypt.New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("crypt.New() failed: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := []byte("old contents")
+	data, err := enc.Encrypt(old)
+	if err != nil {
+		t.Fatalf("Encrypt() failed: %v", err)
+	}
+	if err := s.Upload(ctx, "versions/1", data); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fn := filepath.Join(dir, "file")
+	e := manifest.Entry{
+		Path:     fn,
+		Versions: []manifest.Version{{Name: "versions/1", Mod: mod, Hash: md5.Sum(old), Size: int64(len(old))}},
+	}
+	// The current contents are replaced by the version.
+	if err := ioutil.WriteFile(fn, []byte("current contents"), 0644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	if _, err := restoreVersion(ctx, s, enc, e, versionTime(mod.Add(time.Second)), fn); err == nil {
+		t.Errorf("restoreVersion() of a missing version want error, got nil")
+	}
+	status, err := restoreVersion(ctx, s, enc, e, versionTime(mod), fn)
+	if status != remote.Restored || err != nil {
+		t.Fatalf("restoreVersion() want (%v, nil), got (%v, %v)", remote.Restored, status, err)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, old) {
+		t.Errorf("restored %q want (%q, nil), got (%q, %v)", fn, old, got, err)
+	}
+}
@@ -8,15 +8,35 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"regexp"
 	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/versions"
 )
 
 // Encryption holds the minimum configuration needed to configure
 // crypt.Encryption.
 type Encryption struct {
 	AESPassphrase string `json:"aes_passphrase"`
+	// Compress the data before encrypting it.
+	Compress bool `json:"compress"`
+	// KDFParamsFile is the object in the bucket holding the salt and costs
+	// for deriving the key from the passphrase. Defaults to
+	// crypt.DefaultParamsFile.
+	KDFParamsFile string `json:"kdf_params_file"`
+	// DecryptLegacy enables decrypting objects in the unauthenticated
+	// format written by older versions, see crypt.WithLegacyCBC. Defaults to
+	// true until they are all written again, see LegacyCBC.
+	DecryptLegacy *bool `json:"decrypt_legacy"`
+}
+
+// LegacyCBC reports whether to decrypt the legacy format, unless
+// DecryptLegacy is set to false.
+func (c *Encryption) LegacyCBC() bool {
+	return c.DecryptLegacy == nil || *c.DecryptLegacy
 }
 
 // Duration is a nasty hack to go around serializing/deserializig duration from
@@ -57,6 +77,119 @@ type Sync struct {
 
 	Include []string
 	Exclude []string
+
+	// Layout is how the files are named in storage, one of the Layout*
+	// constants. Defaults to LayoutPath.
+	Layout string `json:"layout"`
+	// BlobsPrefix is prepended to the remote name of files with
+	// LayoutContent. Defaults to DefaultBlobsPrefix.
+	BlobsPrefix string `json:"blobs_prefix"`
+
+	// OnDelete is what to do with the remote copy of files deleted locally,
+	// one of the OnDelete* constants. Defaults to OnDeleteIgnore.
+	OnDelete string `json:"on_delete"`
+	// TrashPrefix is prepended to the remote name of deleted files with
+	// OnDeleteTrash. Defaults to DefaultTrashPrefix.
+	TrashPrefix string `json:"trash_prefix"`
+
+	// Versions is the retention policy for the previous versions of modified
+	// files, copied under VersionsPrefix before being overwritten. By
+	// default no versions are kept.
+	Versions versions.Policy `json:"versions"`
+	// VersionsPrefix is prepended to the remote name of versions. Defaults
+	// to versions.DefaultPrefix.
+	VersionsPrefix string `json:"versions_prefix"`
+
+	// SnapshotInterval is how often to record a snapshot of the synced
+	// files under SnapshotsPrefix. By default no snapshots are recorded.
+	SnapshotInterval Duration `json:"snapshot_interval"`
+	// SnapshotsPrefix is prepended to the remote name of snapshots. Defaults
+	// to DefaultSnapshotsPrefix.
+	SnapshotsPrefix string `json:"snapshots_prefix"`
+
+	// Watch the directories for changes, to sync them without waiting for
+	// the next Interval.
+	Watch bool `json:"watch"`
+	// WatchDelay is how long to wait for changes to settle before syncing
+	// them. Defaults to DefaultWatchDelay.
+	WatchDelay Duration `json:"watch_delay"`
+
+	// UploadConcurrency is how many files are uploaded at once. Defaults to
+	// DefaultUploadConcurrency.
+	UploadConcurrency int `json:"upload_concurrency"`
+	// UploadTimeout is how long uploading a file can take. Defaults to
+	// DefaultUploadTimeout.
+	UploadTimeout Duration `json:"upload_timeout"`
+	// UploadMemory bounds the memory buffering the files uploaded at once,
+	// so that fewer large files are uploaded together. Defaults to
+	// DefaultUploadMemory.
+	UploadMemory int64 `json:"upload_memory"`
+
+	// ProbeURL is requested to check whether the storage is reachable, for
+	// example when it is behind a VPN. By default the storage is listed.
+	ProbeURL string `json:"probe_url"`
+	// ProbeInterval is how often the storage is checked while unreachable.
+	// Defaults to DefaultProbeInterval.
+	ProbeInterval Duration `json:"probe_interval"`
+}
+
+// DefaultProbeInterval is the default Sync.ProbeInterval.
+const DefaultProbeInterval = 30 * time.Second
+
+// DefaultWatchDelay is the default Sync.WatchDelay.
+const DefaultWatchDelay = 5 * time.Second
+
+// Defaults for uploading files.
+const (
+	// DefaultUploadConcurrency is the default Sync.UploadConcurrency.
+	DefaultUploadConcurrency = 4
+	// DefaultUploadTimeout is the default Sync.UploadTimeout.
+	DefaultUploadTimeout = 30 * time.Minute
+	// DefaultUploadMemory is the default Sync.UploadMemory.
+	DefaultUploadMemory = 128 << 20
+)
+
+// Layouts of the files in storage.
+const (
+	// LayoutPath stores files under their path within the remote directory,
+	// the default.
+	LayoutPath = "path"
+	// LayoutContent stores files once per contents, under BlobsPrefix, with
+	// their paths only in the manifest.
+	LayoutContent = "content"
+)
+
+// DefaultBlobsPrefix is the default Sync.BlobsPrefix.
+const DefaultBlobsPrefix = "blobs/"
+
+// Policies for files deleted locally.
+const (
+	// OnDeleteIgnore keeps the remote copy, the default.
+	OnDeleteIgnore = "ignore"
+	// OnDeleteDelete deletes the remote copy.
+	OnDeleteDelete = "delete"
+	// OnDeleteTrash moves the remote copy under TrashPrefix.
+	OnDeleteTrash = "trash"
+)
+
+// DefaultTrashPrefix is the default Sync.TrashPrefix.
+const DefaultTrashPrefix = "trash/"
+
+// DefaultSnapshotsPrefix is the default Sync.SnapshotsPrefix.
+const DefaultSnapshotsPrefix = "snapshots/"
+
+// Restore is the configuration for the tools reading back synced directories,
+// like restoring them, read from the same file as Sync. The directories need
+// not exist.
+type Restore struct {
+	Upload
+
+	Dirs               map[string]string
+	RemoteManifestFile string `json:"remote_manifest_file"`
+	SnapshotsPrefix    string `json:"snapshots_prefix"`
+	BlobsPrefix        string `json:"blobs_prefix"`
+	VersionsPrefix     string `json:"versions_prefix"`
+	TrashPrefix        string `json:"trash_prefix"`
 }
 
 // Upload is the minimum configuration to upload files to cloud.
@@ -65,10 +198,39 @@ type Upload struct {
 	Storage
 }
 
+// Storage types.
+const (
+	// StorageGCS is Google Cloud Storage, the default.
+	StorageGCS = "gcs"
+	// StorageLocal is a local directory.
+	StorageLocal = "local"
+	// StorageS3 is an S3-compatible object store.
+	StorageS3 = "s3"
+)
+
 // Storage is the minumum configuration to connect to the cloud.
 type Storage struct {
+	// Type of the storage, one of the Storage* constants. Defaults to
+	// StorageGCS.
+	Type string `json:"storage_type"`
+
+	// For StorageGCS and StorageS3.
+	BucketName string `json:"bucket_name"`
+
+	// For StorageGCS.
 	Credentials map[string]string `json:"credentials"`
-	BucketName  string            `json:"bucket_name"`
+
+	// For StorageLocal, the directory to store files in.
+	Path string `json:"storage_path"`
+
+	// For StorageS3. Without access key and secret, requests are anonymous.
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey string `json:"s3_secret_key"`
+	// S3Insecure uses plain HTTP instead of HTTPS, for example for a local
+	// MinIO.
+	S3Insecure bool `json:"s3_insecure"`
 }
 
 // C provides the methods to be implemented by all configurations.
@@ -87,11 +249,37 @@ func (c *Encryption) Validate() error {
 	if c.AESPassphrase == "" {
 		return errors.New("aes_passphrase empty")
 	}
+	if c.KDFParamsFile == "" {
+		c.KDFParamsFile = crypt.DefaultParamsFile
+	}
 	return nil
 }
 
 // Validate satisfies interface C.
 func (c *Storage) Validate() error {
+	switch c.Type {
+	case "":
+		c.Type = StorageGCS
+	case StorageGCS:
+	case StorageLocal:
+		if c.Path == "" {
+			return errors.New("storage_path empty")
+		}
+		return nil
+	case StorageS3:
+		if c.S3Endpoint == "" {
+			return errors.New("s3_endpoint empty")
+		}
+		if c.BucketName == "" {
+			return errors.New("bucket_name empty")
+		}
+		if (c.S3AccessKey == "") != (c.S3SecretKey == "") {
+			return errors.New("s3_access_key and s3_secret_key should be both set or both empty")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown storage_type %q", c.Type)
+	}
 	if len(c.Credentials) == 0 {
 		return errors.New("credentials empty")
 	}
@@ -138,6 +326,90 @@ func (c *Sync) Validate() error {
 			return fmt.Errorf("%q is not a valid regexp in exclude: %v", e, err)
 		}
 	}
+	switch c.Layout {
+	case "":
+		c.Layout = LayoutPath
+	case LayoutPath, LayoutContent:
+	default:
+		return fmt.Errorf("unknown layout %q", c.Layout)
+	}
+	if c.BlobsPrefix == "" {
+		c.BlobsPrefix = DefaultBlobsPrefix
+	}
+	switch c.OnDelete {
+	case "":
+		c.OnDelete = OnDeleteIgnore
+	case OnDeleteIgnore, OnDeleteDelete, OnDeleteTrash:
+	default:
+		return fmt.Errorf("unknown on_delete %q", c.OnDelete)
+	}
+	if c.TrashPrefix == "" {
+		c.TrashPrefix = DefaultTrashPrefix
+	}
+	if err := c.Versions.Validate(); err != nil {
+		return fmt.Errorf("versions invalid: %v", err)
+	}
+	if c.VersionsPrefix == "" {
+		c.VersionsPrefix = versions.DefaultPrefix
+	}
+	if c.SnapshotInterval.Duration < 0 {
+		return errors.New("snapshot_interval negative")
+	}
+	if c.SnapshotsPrefix == "" {
+		c.SnapshotsPrefix = DefaultSnapshotsPrefix
+	}
+	if c.WatchDelay.Duration < 0 {
+		return errors.New("watch_delay negative")
+	}
+	if c.WatchDelay.Duration == 0 {
+		c.WatchDelay.Duration = DefaultWatchDelay
+	}
+	if c.UploadConcurrency < 0 || c.UploadTimeout.Duration < 0 || c.UploadMemory < 0 {
+		return errors.New("upload_concurrency, upload_timeout and upload_memory should not be negative")
+	}
+	if c.UploadConcurrency == 0 {
+		c.UploadConcurrency = DefaultUploadConcurrency
+	}
+	if c.UploadTimeout.Duration == 0 {
+		c.UploadTimeout.Duration = DefaultUploadTimeout
+	}
+	if c.UploadMemory == 0 {
+		c.UploadMemory = DefaultUploadMemory
+	}
+	if c.ProbeURL != "" {
+		if u, err := url.Parse(c.ProbeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("probe_url %q is not an HTTP URL", c.ProbeURL)
+		}
+	}
+	if c.ProbeInterval.Duration < 0 {
+		return errors.New("probe_interval negative")
+	}
+	if c.ProbeInterval.Duration == 0 {
+		c.ProbeInterval.Duration = DefaultProbeInterval
+	}
+	return c.Upload.Validate()
+}
+
+// Validate satisfies interface C.
+func (c *Restore) Validate() error {
+	if len(c.Dirs) == 0 {
+		return errors.New("dirs empty: at least one dir needs to be provided")
+	}
+	if c.RemoteManifestFile == "" {
+		return errors.New("remote_manifest_file empty")
+	}
+	if c.SnapshotsPrefix == "" {
+		c.SnapshotsPrefix = DefaultSnapshotsPrefix
+	}
+	if c.BlobsPrefix == "" {
+		c.BlobsPrefix = DefaultBlobsPrefix
+	}
+	if c.VersionsPrefix == "" {
+		c.VersionsPrefix = versions.DefaultPrefix
+	}
+	if c.TrashPrefix == "" {
+		c.TrashPrefix = DefaultTrashPrefix
+	}
 	return c.Upload.Validate()
 }
 
@@ -186,6 +458,11 @@ func (c *Sync) Parse(filename string) error {
 	return ParseConfig(c, filename)
 }
 
+// Parse satisfies interface C.
+func (c *Restore) Parse(filename string) error {
+	return ParseConfig(c, filename)
+}
+
 // Parse satisfies interface C.
 func (c *Upload) Parse(filename string) error {
 	return ParseConfig(c, filename)
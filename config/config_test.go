@@ -192,6 +192,283 @@ func TestParseSyncConfiguration(t *testing.T) {
 }
 `,
 		false,
+	}, {
+		"trash on delete",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "on_delete": "trash",
+    "remote_manifest_file": "manifest",
+    "trash_prefix": "deleted/"
+}
+`,
+		false,
+	}, {
+		"watch",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "watch": true,
+    "watch_delay": "10s"
+}
+`,
+		false,
+	}, {
+		"watch_delay invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "watch": true,
+    "watch_delay": "-1s"
+}
+`,
+		true,
+	}, {
+		"upload settings",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "upload_concurrency": 8,
+    "upload_memory": 67108864,
+    "upload_timeout": "1h"
+}
+`,
+		false,
+	}, {
+		"upload_concurrency invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "upload_concurrency": -1
+}
+`,
+		true,
+	}, {
+		"probe",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "probe_interval": "1m",
+    "probe_url": "https://nas.local/",
+    "remote_manifest_file": "manifest"
+}
+`,
+		false,
+	}, {
+		"probe_url invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "probe_url": "nas.local",
+    "remote_manifest_file": "manifest"
+}
+`,
+		true,
+	}, {
+		"versions",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "versions": {
+        "keep": 3,
+        "daily": 7,
+        "monthly": 12
+    },
+    "snapshot_interval": "24h",
+    "snapshots_prefix": "snaps/",
+    "versions_prefix": "old/"
+}
+`,
+		false,
+	}, {
+		"versions invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "versions": {
+        "weekly": -1
+    }
+}
+`,
+		true,
+	}, {
+		"snapshot_interval invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "remote_manifest_file": "manifest",
+    "snapshot_interval": "-1h"
+}
+`,
+		true,
+	}, {
+		"content layout",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "blobs_prefix": "by-content/",
+    "layout": "content",
+    "on_delete": "delete",
+    "remote_manifest_file": "manifest"
+}
+`,
+		false,
+	}, {
+		"layout invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "layout": "hashed",
+    "remote_manifest_file": "manifest"
+}
+`,
+		true,
+	}, {
+		"on_delete invalid",
+		`
+{
+    "aes_passphrase": "This is safe",
+    "credentials": {
+        "private_key": "key",
+        "project_id": "project",
+        "type": "service_account"
+    },
+    "dirs": {
+        ".": "sample/remote/dir"
+    },
+    "interval": "1h",
+    "manifest_file": "/tmp/manifest",
+    "on_delete": "shred",
+    "remote_manifest_file": "manifest"
+}
+`,
+		true,
 	}, {
 		"include regexp invalid",
 		`
@@ -273,6 +550,33 @@ func TestParseOtherConfiguration(t *testing.T) {
         "type": "service_account"
     }
 }
+`,
+		false,
+	}, {
+		"restore configuration without dirs",
+		&Restore{},
+		`
+{
+    "aes_passphrase": "Sample passphrase",
+    "remote_manifest_file": "manifest",
+    "storage_path": "/mnt/backup",
+    "storage_type": "local"
+}
+`,
+		true,
+	}, {
+		"restore configuration with missing dirs",
+		&Restore{},
+		`
+{
+    "aes_passphrase": "Sample passphrase",
+    "dirs": {
+        "/this/does/not/exist": "remote/dir"
+    },
+    "remote_manifest_file": "manifest",
+    "storage_path": "/mnt/backup",
+    "storage_type": "local"
+}
 `,
 		false,
 	}, {
@@ -305,6 +609,80 @@ func TestParseOtherConfiguration(t *testing.T) {
         "type": "service_account"
     }
 }
+`,
+		false,
+	}, {
+		"unknown storage type",
+		&Storage{},
+		`
+{
+    "storage_type": "tape"
+}
+`,
+		true,
+	}, {
+		"local storage without path",
+		&Storage{},
+		`
+{
+    "storage_type": "local"
+}
+`,
+		true,
+	}, {
+		"valid local storage configuration",
+		&Storage{},
+		`
+{
+    "storage_type": "local",
+    "storage_path": "/mnt/backup"
+}
+`,
+		false,
+	}, {
+		"s3 storage without endpoint",
+		&Storage{},
+		`
+{
+    "storage_type": "s3",
+    "bucket_name": "backup"
+}
+`,
+		true,
+	}, {
+		"s3 storage without bucket",
+		&Storage{},
+		`
+{
+    "storage_type": "s3",
+    "s3_endpoint": "localhost:9000"
+}
+`,
+		true,
+	}, {
+		"s3 storage with access key only",
+		&Storage{},
+		`
+{
+    "storage_type": "s3",
+    "bucket_name": "backup",
+    "s3_endpoint": "localhost:9000",
+    "s3_access_key": "key"
+}
+`,
+		true,
+	}, {
+		"valid s3 storage configuration",
+		&Storage{},
+		`
+{
+    "storage_type": "s3",
+    "bucket_name": "backup",
+    "s3_endpoint": "localhost:9000",
+    "s3_region": "us-east-1",
+    "s3_access_key": "key",
+    "s3_secret_key": "secret"
+}
 `,
 		false,
 	}} {
@@ -316,3 +694,26 @@ func TestParseOtherConfiguration(t *testing.T) {
 		}
 	}
 }
+
+func TestLegacyCBC(t *testing.T) {
+	oldReadFile := ReadFile
+	defer func() { ReadFile = oldReadFile }()
+
+	for _, test := range []struct {
+		config string
+		want   bool
+	}{
+		{`{"aes_passphrase": "Sample passphrase"}`, true},
+		{`{"aes_passphrase": "Sample passphrase", "decrypt_legacy": true}`, true},
+		{`{"aes_passphrase": "Sample passphrase", "decrypt_legacy": false}`, false},
+	} {
+		ReadFile = fakeReadFile(test.config)
+		cfg := &Encryption{}
+		if err := cfg.Parse("config"); err != nil {
+			t.Fatalf("Parse(%s) failed: %v", test.config, err)
+		}
+		if got := cfg.LegacyCBC(); got != test.want {
+			t.Errorf("Parse(%s).LegacyCBC() want %v, got %v", test.config, test.want, got)
+		}
+	}
+}
@@ -1,66 +1,335 @@
+// Package crypt provides the encryption used for everything docsync writes to
+// the cloud.
 package crypt
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
 )
 
 // Encryption allows encrypting/decrypting a sequence of bytes.
 type Encryption interface {
 	Encrypt([]byte) ([]byte, error)
 	Decrypt([]byte) ([]byte, error)
+	// Encrypter returns a writer encrypting everything written to it to w,
+	// without holding more than a chunk in memory. Close must be called to
+	// write the last chunk; it does not close w.
+	Encrypter(w io.Writer) (io.WriteCloser, error)
+	// Decrypter returns a reader decrypting r. Ciphertexts written by
+	// Encrypter are decrypted chunk by chunk, others are read in memory
+	// first.
+	Decrypter(r io.Reader) (io.Reader, error)
+	// HMAC returns a keyed hash of data, with a key derived from the
+	// passphrase and Params.NameSalt, for naming objects after their contents
+	// without revealing them. Unlike the key used for encrypting, it does not
+	// change with the other Params.
+	HMAC(data []byte) []byte
 }
 
-type encryption struct {
-	key   []byte
+// ErrIntegrity is returned by Decrypt when the ciphertext was modified,
+// truncated or encrypted with a different passphrase.
+var ErrIntegrity = errors.New("crypt: ciphertext failed integrity check")
+
+// magic marks ciphertexts using the authenticated format. Anything not starting
+// with it is treated as the legacy AES-CBC format, see WithLegacyCBC.
+var magic = []byte("DSYN")
+
+// key is an AES-256 key ready for use with GCM and, for the legacy format,
+// CBC.
+type key struct {
+	raw   []byte
+	id    [keyIDSize]byte
 	block cipher.Block
+	aead  cipher.AEAD
 }
 
-// New creates a new encryption with the given passphrase.
-func New(passphrase string) (Encryption, error) {
-	key := keyFor(passphrase)
-	block, err := aes.NewCipher(key)
+func newKey(raw []byte) (*key, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
-	return &encryption{
-		key:   key,
+	return &key{
+		raw:   raw,
+		id:    keyID(raw),
 		block: block,
+		aead:  aead,
 	}, nil
 }
 
+type encryption struct {
+	passphrase string
+	// legacy is the key derived without a salt, used to decrypt objects
+	// written before Params were introduced.
+	legacy *key
+	// params and write are used for encrypting. If params is nil, write is
+	// the legacy key.
+	params   *Params
+	write    *key
+	compress bool
+	// name is the key HMAC is derived from, the legacy key if params is nil.
+	name *key
+	// legacyCBC enables decrypting the legacy AES-CBC format.
+	legacyCBC bool
+	// warnCBC logs once that the legacy AES-CBC format is still in use.
+	warnCBC sync.Once
+
+	mu sync.Mutex
+	// keys caches the keys derived for the params found in object headers.
+	keys map[string]*key
+}
+
+// Option configures optional behaviour of an Encryption.
+type Option func(*encryption)
+
+// WithCompression makes Encrypt gzip the data before encrypting it. Decrypt
+// handles compressed and uncompressed data regardless of this option.
+func WithCompression(compress bool) Option {
+	return func(e *encryption) {
+		e.compress = compress
+	}
+}
+
+// WithLegacyCBC makes Decrypt treat anything not in the authenticated format
+// as the legacy AES-CBC format, which is not authenticated. Without it, such
+// data fails to decrypt, so it should only be enabled until all the objects
+// are written again in the authenticated format.
+func WithLegacyCBC(enabled bool) Option {
+	return func(e *encryption) {
+		e.legacyCBC = enabled
+	}
+}
+
+// WithParams makes Encrypt use a key derived with scrypt and the given
+// parameters. Without it, the key is the SHA-256 of the passphrase, which is
+// kept only for compatibility. Decrypt derives the key from the parameters in
+// the object header regardless of this option.
+func WithParams(p *Params) Option {
+	return func(e *encryption) {
+		e.params = p
+	}
+}
+
+// New creates a new encryption with the given passphrase.
+func New(passphrase string, opts ...Option) (Encryption, error) {
+	legacy, err := newKey(keyFor(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	e := &encryption{
+		passphrase: passphrase,
+		legacy:     legacy,
+		write:      legacy,
+		name:       legacy,
+		keys:       make(map[string]*key),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.params != nil {
+		if err := e.params.Validate(); err != nil {
+			return nil, err
+		}
+		if e.write, err = e.derive(e.params); err != nil {
+			return nil, err
+		}
+		if e.name, err = e.derive(e.params.naming()); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
 func keyFor(passphrase string) []byte {
 	h := sha256.New()
 	h.Write([]byte(passphrase))
 	return h.Sum(nil)
 }
 
+// derive returns the key for the given params, deriving it only the first
+// time as scrypt is deliberately slow.
+func (e *encryption) derive(p *Params) (*key, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := string(p.marshal())
+	if k, found := e.keys[id]; found {
+		return k, nil
+	}
+	raw, err := p.key(e.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k, err := newKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	e.keys[id] = k
+	return k, nil
+}
+
+func (e *encryption) header(version byte) *header {
+	h := &header{
+		version: version,
+		cipher:  cipherAES256GCM,
+		kdf:     kdfSHA256,
+		keyID:   e.write.id,
+	}
+	if e.params != nil {
+		h.kdf = kdfScrypt
+		h.kdfParams = e.params.marshal()
+	}
+	if e.compress {
+		h.flags |= flagCompressed
+	}
+	return h
+}
+
+// keyForHeader returns the key an object with header h was written with.
+func (e *encryption) keyForHeader(h *header) (*key, error) {
+	var k *key
+	switch h.kdf {
+	case kdfSHA256:
+		k = e.legacy
+	case kdfScrypt:
+		p, err := unmarshalParams(h.kdfParams)
+		if err != nil {
+			return nil, err
+		}
+		if k, err = e.derive(p); err != nil {
+			return nil, err
+		}
+	}
+	if h.keyID != k.id {
+		return nil, ErrKeyMismatch
+	}
+	return k, nil
+}
+
+// hmacLabel derives the key of HMAC from the naming key.
+var hmacLabel = []byte("docsync content names")
+
+func (e *encryption) HMAC(data []byte) []byte {
+	sub := hmac.New(sha256.New, e.name.raw)
+	sub.Write(hmacLabel)
+	mac := hmac.New(sha256.New, sub.Sum(nil))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// parseHeader parses and validates the header at the start of src, returning
+// as well the key to decrypt the rest with.
+func (e *encryption) parseHeader(src []byte) (h *header, k *key, raw, rest []byte, err error) {
+	if h, raw, rest, err = parseHeader(src); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err := h.validate(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if k, err = e.keyForHeader(h); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return h, k, raw, rest, nil
+}
+
+// Encrypt returns the header, nonce and the sealed src. The header is
+// authenticated as additional data.
 func (e *encryption) Encrypt(src []byte) ([]byte, error) {
-	// +1 = need to account for the padding byte as well.
-	padding := len(e.key) - (len(src)+1)%len(e.key)
-	nsrc := append([]byte{byte(padding)}, make([]byte, padding)...)
-	nsrc = append(nsrc, src...)
-	// TODO(andreich): HMAC as well.
-	size := e.block.BlockSize()
-	dst := make([]byte, size+len(nsrc))
-	if _, err := io.ReadFull(rand.Reader, dst[:size]); err != nil {
+	h := e.header(versionHeader)
+	if e.compress {
+		var err error
+		if src, err = compress(src); err != nil {
+			return nil, err
+		}
+	}
+	header := h.marshal()
+	aead := e.write.aead
+	size := len(header) + aead.NonceSize()
+	dst := make([]byte, size, size+len(src)+aead.Overhead())
+	copy(dst, header)
+	nonce := dst[len(header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	mode := cipher.NewCBCEncrypter(e.block, dst[:size])
-	mode.CryptBlocks(dst[size:], nsrc)
-	return dst, nil
+	return aead.Seal(dst, nonce, src, header), nil
 }
 
+// Decrypt dispatches on the format version to decrypt src.
 func (e *encryption) Decrypt(src []byte) ([]byte, error) {
-	size := e.block.BlockSize()
-	mode := cipher.NewCBCDecrypter(e.block, src[:size])
-	mode.CryptBlocks(src[size:], src[size:])
-	padding := int(src[size])
-	var dst []byte
-	// +1 = need to account for the padding byte as well.
-	dst = append(dst, src[size+padding+1:]...)
+	if !bytes.HasPrefix(src, magic) {
+		return e.decryptCBC(src)
+	}
+	if len(src) < len(magic)+1 {
+		return nil, ErrIntegrity
+	}
+	switch version := src[len(magic)]; version {
+	case versionHeader:
+		h, k, raw, rest, err := e.parseHeader(src)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := decryptGCM(k, raw, rest)
+		if err != nil {
+			return nil, err
+		}
+		if h.flags&flagCompressed != 0 {
+			return decompress(dst)
+		}
+		return dst, nil
+	case versionStream:
+		r, err := e.Decrypter(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("crypt: unsupported format version %d", version)
+	}
+}
+
+// decryptGCM opens the nonce and sealed data in src with k, authenticating
+// header as well.
+func decryptGCM(k *key, header, src []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(src) < size+k.aead.Overhead() {
+		return nil, ErrIntegrity
+	}
+	dst, err := k.aead.Open(nil, src[:size], src[size:], header)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
 	return dst, nil
 }
+
+func compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
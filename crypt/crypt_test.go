@@ -1,6 +1,8 @@
 package crypt
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
 	"fmt"
 	"math"
@@ -45,3 +47,179 @@ func TestEncryptDecrypt(t *testing.T) {
 		}
 	}
 }
+
+// encryptCBC is the encryption used before the authenticated format, kept to
+// check that old objects still decrypt.
+func encryptCBC(e *encryption, src []byte) []byte {
+	k := e.legacy
+	padding := len(k.raw) - (len(src)+1)%len(k.raw)
+	nsrc := append([]byte{byte(padding)}, make([]byte, padding)...)
+	return sealCBC(e, append(nsrc, src...))
+}
+
+// sealCBC encrypts the padded nsrc like encryptCBC.
+func sealCBC(e *encryption, nsrc []byte) []byte {
+	k := e.legacy
+	size := k.block.BlockSize()
+	dst := make([]byte, size+len(nsrc))
+	copy(dst[:size], getBytes(size))
+	mode := cipher.NewCBCEncrypter(k.block, dst[:size])
+	mode.CryptBlocks(dst[size:], nsrc)
+	return dst
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	e, err := New("this is a passphrase", WithLegacyCBC(true))
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	for _, count := range []int{0, 1, 31, 32, 33, 1000} {
+		src := getBytes(count)
+		dsrc, err := e.Decrypt(encryptCBC(e.(*encryption), src))
+		if err != nil {
+			t.Errorf("decrypting legacy %d bytes: %v", count, err)
+		}
+		if !bytes.Equal(src, dsrc) {
+			t.Errorf("legacy decryption mismatch for %d bytes:\n% x\n% x", count, src, dsrc)
+		}
+	}
+	for _, src := range [][]byte{nil, getBytes(15), getBytes(33)} {
+		if _, err := e.Decrypt(src); err == nil {
+			t.Errorf("Decrypt(% x) want error, got nil", src)
+		}
+	}
+	enc := e.(*encryption)
+	for _, test := range []struct {
+		desc string
+		nsrc []byte
+	}{
+		{"no padding", append([]byte{0}, getBytes(31)...)},
+		{"too much padding", append([]byte{33}, make([]byte, 63)...)},
+		{"padding not zero", append([]byte{2, 0, 1}, getBytes(29)...)},
+		{"padding longer than the data", append([]byte{32}, make([]byte, 31)...)},
+	} {
+		if got, err := e.Decrypt(sealCBC(enc, test.nsrc)); err != errMalformedCBC {
+			t.Errorf("%s: Decrypt() want %v, got (% x, %v)", test.desc, errMalformedCBC, got, err)
+		}
+	}
+	if _, err := e.Decrypt(encryptCBC(enc, getBytes(31))[1:]); err != errMalformedCBC {
+		t.Errorf("Decrypt() not a multiple of the key size want %v, got %v", errMalformedCBC, err)
+	}
+
+	disabled, err := New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	if _, err := disabled.Decrypt(encryptCBC(enc, getBytes(100))); err != errLegacyCBC {
+		t.Errorf("Decrypt() without WithLegacyCBC want %v, got %v", errLegacyCBC, err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	// Tampering with the magic must not pass for the legacy format either.
+	e, err := New("this is a passphrase", WithLegacyCBC(true))
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	other, err := New("this is another passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := getBytes(100)
+	dst, err := e.Encrypt(src)
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	headerLen := len(e.(*encryption).header(versionHeader).marshal())
+	for i := 0; i < len(dst); i++ {
+		tampered := append([]byte{}, dst...)
+		tampered[i] ^= 0x01
+		_, err := e.Decrypt(tampered)
+		if err == nil {
+			t.Errorf("Decrypt with byte %d flipped: want error, got nil", i)
+		}
+		if i >= headerLen && err != ErrIntegrity {
+			t.Errorf("Decrypt with byte %d flipped: want %v, got %v", i, ErrIntegrity, err)
+		}
+	}
+	for _, size := range []int{len(magic), len(magic) + 1, len(magic) + 10, headerLen, len(dst) - 1} {
+		if _, err := e.Decrypt(append([]byte{}, dst[:size]...)); err == nil {
+			t.Errorf("Decrypt truncated to %d bytes: want error, got nil", size)
+		}
+	}
+	if _, err := other.Decrypt(append([]byte{}, dst...)); err != ErrKeyMismatch {
+		t.Errorf("Decrypt with another passphrase: want %v, got %v", ErrKeyMismatch, err)
+	}
+}
+
+func TestDecryptVersions(t *testing.T) {
+	e, err := New("this is a passphrase", WithLegacyCBC(true))
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := getBytes(100)
+	enc := e.(*encryption)
+	nonce := getBytes(enc.legacy.aead.NonceSize())
+	for _, test := range []struct {
+		desc string
+		data []byte
+		err  bool
+	}{{
+		"legacy CBC",
+		encryptCBC(enc, src),
+		false,
+	}, {
+		"unknown version",
+		append(append([]byte{}, magic...), 0xff, 1, 2, 3),
+		true,
+	}, {
+		"unknown cipher",
+		append((&header{version: versionHeader, cipher: 0xff, kdf: kdfSHA256, keyID: enc.legacy.id}).marshal(), nonce...),
+		true,
+	}, {
+		"unknown kdf",
+		append((&header{version: versionHeader, cipher: cipherAES256GCM, kdf: 0xff, keyID: enc.legacy.id}).marshal(), nonce...),
+		true,
+	}, {
+		"unknown flags",
+		append((&header{version: versionHeader, cipher: cipherAES256GCM, kdf: kdfSHA256, keyID: enc.legacy.id, flags: 0x80}).marshal(), nonce...),
+		true,
+	}} {
+		got, err := e.Decrypt(test.data)
+		if test.err != (err != nil) {
+			t.Errorf("%s: Decrypt() want error %v, got %v", test.desc, test.err, err)
+		}
+		if !test.err && !bytes.Equal(got, src) {
+			t.Errorf("%s: Decrypt() mismatch:\n% x\n% x", test.desc, src, got)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	e, err := New("this is a passphrase", WithCompression(true))
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	plain, err := New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := bytes.Repeat([]byte("compressible "), 1000)
+	dst, err := e.Encrypt(src)
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	if len(dst) >= len(src) {
+		t.Errorf("compressed ciphertext has %d bytes, want less than %d", len(dst), len(src))
+	}
+	// Decryption should not depend on the compression option.
+	for _, d := range []Encryption{e, plain} {
+		got, err := d.Decrypt(dst)
+		if err != nil {
+			t.Errorf("decrypting: %v", err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("decryption mismatch for compressed data")
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Format versions, stored right after magic.
+const (
+	// versionHeader is followed by the fields of header and the data sealed
+	// at once.
+	versionHeader byte = 2
+	// versionStream is followed by the fields of header and the data sealed
+	// in chunks, see stream.go.
+	versionStream byte = 3
+)
+
+// Ciphers recorded in the header.
+const (
+	cipherAES256GCM byte = 1
+)
+
+// Key derivation functions recorded in the header.
+const (
+	// kdfSHA256 is the SHA-256 of the passphrase, without parameters.
+	kdfSHA256 byte = 1
+	// kdfScrypt is scrypt with the marshaled Params as parameters.
+	kdfScrypt byte = 2
+)
+
+// Flags recorded in the header.
+const (
+	flagCompressed byte = 1 << iota
+)
+
+const keyIDSize = 8
+
+var errShortHeader = errors.New("crypt: ciphertext header truncated")
+
+// ErrKeyMismatch is returned by Decrypt when the ciphertext was written with a
+// key other than the one of the Encryption.
+var ErrKeyMismatch = errors.New("crypt: ciphertext was encrypted with a different key")
+
+// header describes how a ciphertext was written. It is authenticated together
+// with the ciphertext, so it cannot be changed without Decrypt noticing.
+//
+// Layout after magic and version (versionHeader or versionStream):
+//	cipher     1 byte
+//	kdf        1 byte
+//	kdf params 2 bytes big endian length, followed by the params
+//	key ID     8 bytes
+//	flags      1 byte
+type header struct {
+	version   byte
+	cipher    byte
+	kdf       byte
+	kdfParams []byte
+	keyID     [keyIDSize]byte
+	flags     byte
+}
+
+// keyID identifies key without revealing it.
+func keyID(key []byte) [keyIDSize]byte {
+	var id [keyIDSize]byte
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("docsync key id"))
+	copy(id[:], mac.Sum(nil))
+	return id
+}
+
+func (h *header) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	buf.WriteByte(h.version)
+	buf.WriteByte(h.cipher)
+	buf.WriteByte(h.kdf)
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(h.kdfParams)))
+	buf.Write(size[:])
+	buf.Write(h.kdfParams)
+	buf.Write(h.keyID[:])
+	buf.WriteByte(h.flags)
+	return buf.Bytes()
+}
+
+// fixedHeaderSize is the size of the header up to the kdf params.
+var fixedHeaderSize = len(magic) + 5
+
+// headerSize returns the size of the header at the start of src, which should
+// contain at least fixedHeaderSize bytes.
+func headerSize(src []byte) int {
+	size := int(binary.BigEndian.Uint16(src[len(magic)+3:]))
+	return fixedHeaderSize + size + keyIDSize + 1
+}
+
+// parseHeader parses the header at the start of src, which should already be
+// known to start with magic and versionHeader or versionStream. It returns the
+// header, the raw header bytes and the remaining ciphertext.
+func parseHeader(src []byte) (*header, []byte, []byte, error) {
+	if len(src) < fixedHeaderSize || len(src) < headerSize(src) {
+		return nil, nil, nil, errShortHeader
+	}
+	pos := len(magic)
+	h := &header{
+		version: src[pos],
+		cipher:  src[pos+1],
+		kdf:     src[pos+2],
+	}
+	size := int(binary.BigEndian.Uint16(src[pos+3:]))
+	pos = fixedHeaderSize
+	h.kdfParams = src[pos : pos+size]
+	pos += size
+	copy(h.keyID[:], src[pos:])
+	pos += keyIDSize
+	h.flags = src[pos]
+	pos++
+	return h, src[:pos], src[pos:], nil
+}
+
+func (h *header) validate() error {
+	if h.cipher != cipherAES256GCM {
+		return fmt.Errorf("crypt: unsupported cipher %d", h.cipher)
+	}
+	switch {
+	case h.kdf == kdfSHA256 && len(h.kdfParams) != 0:
+		return errors.New("crypt: unexpected key derivation parameters")
+	case h.kdf != kdfSHA256 && h.kdf != kdfScrypt:
+		return fmt.Errorf("crypt: unsupported key derivation %d", h.kdf)
+	}
+	if h.flags&^flagCompressed != 0 {
+		return fmt.Errorf("crypt: unsupported flags %#x", h.flags)
+	}
+	return nil
+}
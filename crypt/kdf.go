@@ -0,0 +1,172 @@
+package crypt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// DefaultParamsFile is the name of the object holding the Params of a bucket.
+const DefaultParamsFile = "docsync.kdf.json"
+
+const (
+	saltSize = 16
+	// Reject costs below the recommended ones, which would make guessing the
+	// passphrase cheaper.
+	minN = 1 << 15
+	minR = 8
+	// Keep scrypt from using more than 1GiB, or taking minutes, when deriving
+	// a key from parameters read from an object header.
+	maxN      = 1 << 20
+	maxP      = 16
+	maxMemory = 1 << 30
+	// The costs of deriving the key naming objects never change, so that
+	// neither do the names. They are the ones NewParams always used, keeping
+	// the names given before Params.NameSalt was recorded.
+	nameN = 1 << 15
+	nameR = 8
+	nameP = 1
+)
+
+// Params are the parameters for deriving a key from the passphrase with scrypt.
+// They are shared by everything writing to the same bucket and are recorded in
+// the header of every object, so Decrypt can always derive the right key.
+type Params struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	// NameSalt is the salt of the key naming objects after their contents,
+	// see Encryption.HMAC. It is kept when the other parameters change, so
+	// that the same contents keep the same name. Defaults to Salt, for
+	// parameters created before it was recorded.
+	NameSalt []byte `json:"name_salt,omitempty"`
+}
+
+// NewParams creates Params with a random salt and the recommended costs.
+func NewParams() (*Params, error) {
+	p := &Params{
+		Salt:     make([]byte, saltSize),
+		N:        1 << 15,
+		R:        8,
+		P:        1,
+		NameSalt: make([]byte, saltSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, p.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, p.NameSalt); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks that scrypt accepts the parameters, that they are not weaker
+// than the recommended ones and that deriving the key does not need an
+// unreasonable amount of memory or time.
+func (p *Params) Validate() error {
+	if len(p.Salt) < 8 {
+		return errors.New("crypt: salt should have at least 8 bytes")
+	}
+	if p.NameSalt != nil && len(p.NameSalt) < 8 {
+		return errors.New("crypt: name salt should have at least 8 bytes")
+	}
+	if p.N < minN || p.N > maxN || p.N&(p.N-1) != 0 {
+		return fmt.Errorf("crypt: scrypt N=%d should be a power of 2 from %d to %d", p.N, minN, maxN)
+	}
+	if p.R < minR {
+		return fmt.Errorf("crypt: scrypt r=%d should be at least %d", p.R, minR)
+	}
+	if p.P <= 0 || p.P > maxP {
+		return fmt.Errorf("crypt: scrypt p=%d should be from 1 to %d", p.P, maxP)
+	}
+	if 128*int64(p.N)*int64(p.R) > maxMemory {
+		return fmt.Errorf("crypt: scrypt N=%d, r=%d need too much memory", p.N, p.R)
+	}
+	return nil
+}
+
+// naming returns the parameters of the key naming objects.
+func (p *Params) naming() *Params {
+	salt := p.NameSalt
+	if salt == nil {
+		salt = p.Salt
+	}
+	return &Params{Salt: salt, N: nameN, R: nameR, P: nameP}
+}
+
+func (p *Params) key(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), p.Salt, p.N, p.R, p.P, 32)
+}
+
+// marshal encodes the parameters for the object header as N, r, p as 32 bits
+// big endian integers followed by the salt.
+func (p *Params) marshal() []byte {
+	b := make([]byte, 12, 12+len(p.Salt))
+	binary.BigEndian.PutUint32(b[0:], uint32(p.N))
+	binary.BigEndian.PutUint32(b[4:], uint32(p.R))
+	binary.BigEndian.PutUint32(b[8:], uint32(p.P))
+	return append(b, p.Salt...)
+}
+
+func unmarshalParams(b []byte) (*Params, error) {
+	if len(b) < 12 {
+		return nil, errShortHeader
+	}
+	p := &Params{
+		N:    int(binary.BigEndian.Uint32(b[0:])),
+		R:    int(binary.BigEndian.Uint32(b[4:])),
+		P:    int(binary.BigEndian.Uint32(b[8:])),
+		Salt: append([]byte{}, b[12:]...),
+	}
+	return p, p.Validate()
+}
+
+// ParamsStore is the part of storage.Storage needed to keep Params in the
+// bucket.
+type ParamsStore interface {
+	Upload(ctx context.Context, name string, contents []byte) error
+	Download(ctx context.Context, name string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// LoadOrCreateParams reads the Params stored under name. If there is no such
+// object yet, new Params are created and stored there.
+func LoadOrCreateParams(ctx context.Context, s ParamsStore, name string) (*Params, error) {
+	// List rather than Download to tell a missing object apart from an
+	// unreachable bucket: creating a new salt in the latter case would give
+	// the bucket a second key.
+	names, err := s.List(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		if n != name {
+			continue
+		}
+		data, err := s.Download(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		p := &Params{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("crypt: parsing %q: %v", name, err)
+		}
+		return p, p.Validate()
+	}
+	p, err := NewParams()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return p, s.Upload(ctx, name, data)
+}
@@ -0,0 +1,239 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testParams are the cheapest to derive, to keep tests fast.
+func testParams(t *testing.T) *Params {
+	p, err := NewParams()
+	if err != nil {
+		t.Fatalf("NewParams() failed: %v", err)
+	}
+	p.N = minN
+	return p
+}
+
+func TestParamsValidate(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		params Params
+		err    bool
+	}{{
+		"valid",
+		Params{Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1},
+		false,
+	}, {
+		"short salt",
+		Params{Salt: make([]byte, 4), N: 1 << 15, R: 8, P: 1},
+		true,
+	}, {
+		"N not a power of 2",
+		Params{Salt: make([]byte, 16), N: 1000, R: 8, P: 1},
+		true,
+	}, {
+		"N too small",
+		Params{Salt: make([]byte, 16), N: 1, R: 8, P: 1},
+		true,
+	}, {
+		"N below the recommended cost",
+		Params{Salt: make([]byte, 16), N: 1 << 14, R: 8, P: 1},
+		true,
+	}, {
+		"N too large",
+		Params{Salt: make([]byte, 16), N: 1 << 21, R: 1, P: 1},
+		true,
+	}, {
+		"r below the recommended cost",
+		Params{Salt: make([]byte, 16), N: 1 << 15, R: 4, P: 1},
+		true,
+	}, {
+		"invalid p",
+		Params{Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 0},
+		true,
+	}, {
+		"p too large",
+		Params{Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1 << 20},
+		true,
+	}, {
+		"too much memory",
+		Params{Salt: make([]byte, 16), N: 1 << 20, R: 16, P: 1},
+		true,
+	}} {
+		if err := test.params.Validate(); test.err != (err != nil) {
+			t.Errorf("%s: Validate() want error %v, got %v", test.desc, test.err, err)
+		}
+	}
+}
+
+func TestParamsMarshal(t *testing.T) {
+	p := testParams(t)
+	got, err := unmarshalParams(p.marshal())
+	if err != nil {
+		t.Fatalf("unmarshalParams() failed: %v", err)
+	}
+	// The name salt is not needed for decrypting.
+	want := *p
+	want.NameSalt = nil
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("unmarshalParams() want %+v, got %+v", &want, got)
+	}
+	if _, err := unmarshalParams(p.marshal()[:10]); err == nil {
+		t.Errorf("unmarshalParams() of truncated params want error, got nil")
+	}
+}
+
+func TestEncryptDecryptWithParams(t *testing.T) {
+	p := testParams(t)
+	e, err := New("this is a passphrase", WithParams(p))
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := getBytes(1000)
+	dst, err := e.Encrypt(src)
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	if legacy := e.(*encryption).legacy; bytes.Contains(dst, legacy.id[:]) {
+		t.Errorf("ciphertext references the legacy key")
+	}
+	// Decrypting needs only the passphrase, the params are in the header.
+	d, err := New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	got, err := d.Decrypt(dst)
+	if err != nil {
+		t.Errorf("decrypting: %v", err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Errorf("decryption mismatch for %d bytes", len(src))
+	}
+	other, err := New("this is another passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	if _, err := other.Decrypt(dst); err != ErrKeyMismatch {
+		t.Errorf("Decrypt with another passphrase: want %v, got %v", ErrKeyMismatch, err)
+	}
+	if _, err := New("this is a passphrase", WithParams(&Params{})); err == nil {
+		t.Errorf("New() with invalid params want error, got nil")
+	}
+}
+
+type fakeStore struct {
+	objects map[string][]byte
+	err     error
+}
+
+func (f *fakeStore) Upload(ctx context.Context, name string, contents []byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.objects[name] = contents
+	return nil
+}
+
+func (f *fakeStore) Download(ctx context.Context, name string) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.objects[name], nil
+}
+
+func (f *fakeStore) List(ctx context.Context, prefix string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var res []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+func TestLoadOrCreateParams(t *testing.T) {
+	ctx := context.Background()
+	s := &fakeStore{objects: map[string][]byte{
+		DefaultParamsFile + ".old": []byte("not json"),
+	}}
+	created, err := LoadOrCreateParams(ctx, s, DefaultParamsFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateParams() failed: %v", err)
+	}
+	if _, found := s.objects[DefaultParamsFile]; !found {
+		t.Errorf("LoadOrCreateParams() did not store the params")
+	}
+	loaded, err := LoadOrCreateParams(ctx, s, DefaultParamsFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateParams() failed: %v", err)
+	}
+	if !reflect.DeepEqual(created, loaded) {
+		t.Errorf("LoadOrCreateParams() want %+v, got %+v", created, loaded)
+	}
+
+	s.objects[DefaultParamsFile] = []byte("not json")
+	if _, err := LoadOrCreateParams(ctx, s, DefaultParamsFile); err == nil {
+		t.Errorf("LoadOrCreateParams() of invalid params want error, got nil")
+	}
+	unreachable := &fakeStore{err: errors.New("unreachable")}
+	if _, err := LoadOrCreateParams(ctx, unreachable, DefaultParamsFile); err == nil {
+		t.Errorf("LoadOrCreateParams() of unreachable store want error, got nil")
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	params := testParams(t)
+	newEnc := func(passphrase string, opts ...Option) Encryption {
+		e, err := New(passphrase, opts...)
+		if err != nil {
+			t.Fatalf("New() failed: %v", err)
+		}
+		return e
+	}
+	e := newEnc("this is a passphrase", WithParams(params))
+	data := []byte("contents hash")
+	got := e.HMAC(data)
+	if len(got) != 32 || bytes.Contains(got, data) {
+		t.Errorf("HMAC() want 32 bytes not containing the data, got %x", got)
+	}
+	if again := newEnc("this is a passphrase", WithParams(params)).HMAC(data); !bytes.Equal(again, got) {
+		t.Errorf("HMAC() with the same key want %x, got %x", got, again)
+	}
+	// Changing the other parameters keeps the names.
+	changed, err := NewParams()
+	if err != nil {
+		t.Fatalf("NewParams() failed: %v", err)
+	}
+	changed.N, changed.NameSalt = params.N*2, params.NameSalt
+	if again := newEnc("this is a passphrase", WithParams(changed)).HMAC(data); !bytes.Equal(again, got) {
+		t.Errorf("HMAC() with other params and the same name salt want %x, got %x", got, again)
+	}
+	// Parameters without a name salt keep the names given with their salt.
+	old := *params
+	old.NameSalt = nil
+	want := newEnc("this is a passphrase", WithParams(&Params{Salt: params.Salt, N: nameN, R: nameR, P: nameP})).(*encryption).write.raw
+	if k := newEnc("this is a passphrase", WithParams(&old)).(*encryption).name.raw; !bytes.Equal(k, want) {
+		t.Errorf("naming key without name salt want the key of the salt %x, got %x", want, k)
+	}
+	for _, test := range []struct {
+		desc string
+		e    Encryption
+		data []byte
+	}{
+		{"other data", e, []byte("other hash")},
+		{"other passphrase", newEnc("other passphrase", WithParams(params)), data},
+		{"legacy key", newEnc("this is a passphrase"), data},
+	} {
+		if h := test.e.HMAC(test.data); bytes.Equal(h, got) {
+			t.Errorf("HMAC() with %s want different from %x, got the same", test.desc, got)
+		}
+	}
+}
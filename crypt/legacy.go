@@ -0,0 +1,46 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"errors"
+	"log"
+)
+
+var (
+	errMalformedCBC = errors.New("crypt: malformed legacy ciphertext")
+	errLegacyCBC    = errors.New(`crypt: not in the authenticated format, and the legacy format is not enabled, see "decrypt_legacy"`)
+)
+
+// decryptCBC decrypts the unauthenticated AES-CBC format written by docsync
+// before the switch to AES-GCM: a random IV followed by the CBC blocks of a
+// padding length byte, the padding and the plaintext. The padding is 1 to 32
+// zero bytes, making the blocks a multiple of the key size. It is kept so that
+// existing objects in the bucket can still be read, if enabled by
+// WithLegacyCBC.
+func (e *encryption) decryptCBC(src []byte) ([]byte, error) {
+	if !e.legacyCBC {
+		return nil, errLegacyCBC
+	}
+	e.warnCBC.Do(func() {
+		log.Printf(`crypt: decrypting objects in the unauthenticated legacy format; set "decrypt_legacy" to false once they are written again`)
+	})
+	size := e.legacy.block.BlockSize()
+	keySize := len(e.legacy.raw)
+	if len(src) < size+keySize || (len(src)-size)%keySize != 0 {
+		return nil, errMalformedCBC
+	}
+	dst := make([]byte, len(src)-size)
+	mode := cipher.NewCBCDecrypter(e.legacy.block, src[:size])
+	mode.CryptBlocks(dst, src[size:])
+	padding := int(dst[0])
+	// +1 = need to account for the padding byte as well.
+	if padding < 1 || padding > keySize || padding+1 > len(dst) {
+		return nil, errMalformedCBC
+	}
+	for _, b := range dst[1 : padding+1] {
+		if b != 0 {
+			return nil, errMalformedCBC
+		}
+	}
+	return dst[padding+1:], nil
+}
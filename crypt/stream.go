@@ -0,0 +1,247 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// The streaming format (versionStream) follows the header with a random nonce
+// prefix and the data sealed in chunks of ChunkSize bytes. The nonce of each
+// chunk is the prefix, the chunk index and a byte marking the last chunk, so
+// chunks cannot be reordered, dropped or the stream truncated without Decrypter
+// noticing. The header is authenticated with every chunk.
+const (
+	prefixSize  = 7
+	lastChunk   = 1
+	streamNonce = prefixSize + 4 + 1
+)
+
+// ChunkSize is the size of the chunks of the streaming format, which an
+// Encrypter or Decrypter keeps in memory.
+const ChunkSize = 64 * 1024
+
+var errClosed = errors.New("crypt: Encrypter already closed")
+
+type chunkWriter struct {
+	w      io.Writer
+	k      *key
+	header []byte
+	prefix []byte
+	index  uint32
+	buf    []byte
+	sealed []byte
+	err    error
+}
+
+func (e *encryption) Encrypter(w io.Writer) (io.WriteCloser, error) {
+	h := e.header(versionStream)
+	cw := &chunkWriter{
+		w:      w,
+		k:      e.write,
+		header: h.marshal(),
+		prefix: make([]byte, prefixSize),
+		buf:    make([]byte, 0, ChunkSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, cw.prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(cw.header); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(cw.prefix); err != nil {
+		return nil, err
+	}
+	if e.compress {
+		return &gzipWriter{gzip.NewWriter(cw), cw}, nil
+	}
+	return cw, nil
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, streamNonce)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], index)
+	if last {
+		nonce[streamNonce-1] = lastChunk
+	}
+	return nonce
+}
+
+// seal writes the buffered data as a chunk.
+func (cw *chunkWriter) seal(last bool) error {
+	nonce := chunkNonce(cw.prefix, cw.index, last)
+	cw.sealed = cw.k.aead.Seal(cw.sealed[:0], nonce, cw.buf, cw.header)
+	cw.index++
+	cw.buf = cw.buf[:0]
+	_, err := cw.w.Write(cw.sealed)
+	return err
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, as the last
+		// chunk is sealed on Close.
+		if len(cw.buf) == ChunkSize {
+			if cw.err = cw.seal(false); cw.err != nil {
+				return written, cw.err
+			}
+		}
+		n := copy(cw.buf[len(cw.buf):ChunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (cw *chunkWriter) Close() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	if cw.err = cw.seal(true); cw.err != nil {
+		return cw.err
+	}
+	cw.err = errClosed
+	return nil
+}
+
+// gzipWriter compresses the data before writing it to the chunkWriter.
+type gzipWriter struct {
+	*gzip.Writer
+	cw *chunkWriter
+}
+
+func (g *gzipWriter) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		return err
+	}
+	return g.cw.Close()
+}
+
+type chunkReader struct {
+	r      *bufio.Reader
+	k      *key
+	header []byte
+	prefix []byte
+	index  uint32
+	sealed []byte
+	buf    []byte
+	err    error
+}
+
+func (e *encryption) Decrypter(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, ChunkSize+e.write.aead.Overhead())
+	start, err := br.Peek(len(magic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(start) <= len(magic) || !bytes.HasPrefix(start, magic) || start[len(magic)] != versionStream {
+		// Formats without chunks need to be decrypted at once.
+		src, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := e.Decrypt(src)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(dst), nil
+	}
+	src, err := br.Peek(fixedHeaderSize)
+	if err != nil {
+		return nil, errShortHeader
+	}
+	if src, err = br.Peek(headerSize(src)); err != nil {
+		return nil, errShortHeader
+	}
+	h, k, raw, _, err := e.parseHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	cr := &chunkReader{
+		r:      br,
+		k:      k,
+		header: append([]byte{}, raw...),
+		prefix: make([]byte, prefixSize),
+		sealed: make([]byte, ChunkSize+k.aead.Overhead()),
+	}
+	if _, err := br.Discard(len(raw)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(br, cr.prefix); err != nil {
+		return nil, ErrIntegrity
+	}
+	if h.flags&flagCompressed != 0 {
+		return gzip.NewReader(cr)
+	}
+	return cr, nil
+}
+
+// open reads and decrypts the next chunk into buf.
+func (cr *chunkReader) open() error {
+	n, err := io.ReadFull(cr.r, cr.sealed)
+	last := false
+	switch err {
+	case nil:
+		_, err := cr.r.Peek(1)
+		last = err == io.EOF
+	case io.ErrUnexpectedEOF, io.EOF:
+		last = true
+	default:
+		return err
+	}
+	if n < cr.k.aead.Overhead() {
+		return ErrIntegrity
+	}
+	nonce := chunkNonce(cr.prefix, cr.index, last)
+	if cr.buf, err = cr.k.aead.Open(cr.sealed[:0], nonce, cr.sealed[:n], cr.header); err != nil {
+		return ErrIntegrity
+	}
+	cr.index++
+	if last {
+		cr.err = io.EOF
+	}
+	return nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if err := cr.open(); err != nil {
+			cr.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// EncryptReader returns a reader of the ciphertext e.Encrypter writes for
+// everything in r, for passing to APIs reading their input. Close must be
+// called once done with the returned reader, even if it was not fully read.
+func EncryptReader(e Encryption, r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := e.Encrypter(pw)
+		if err == nil {
+			if _, err = io.Copy(w, r); err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,148 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptStream(t *testing.T, e Encryption, src []byte) []byte {
+	var buf bytes.Buffer
+	w, err := e.Encrypter(&buf)
+	if err != nil {
+		t.Fatalf("Encrypter() failed: %v", err)
+	}
+	// Write in uneven pieces to cross chunk boundaries.
+	for len(src) > 0 {
+		n := 1000
+		if n > len(src) {
+			n = len(src)
+		}
+		if _, err := w.Write(src[:n]); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		src = src[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decryptStream(e Encryption, src []byte) ([]byte, error) {
+	r, err := e.Decrypter(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestStream(t *testing.T) {
+	p := testParams(t)
+	for _, compress := range []bool{false, true} {
+		e, err := New("this is a passphrase", WithParams(p), WithCompression(compress))
+		if err != nil {
+			t.Fatalf("could not initialize encryption: %v", err)
+		}
+		for _, count := range []int{0, 1, 1000, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize, 3*ChunkSize + 17} {
+			src := getBytes(count)
+			dst := encryptStream(t, e, src)
+			got, err := decryptStream(e, dst)
+			if err != nil {
+				t.Errorf("compress %v: decrypting %d bytes: %v", compress, count, err)
+			}
+			if !bytes.Equal(got, src) {
+				t.Errorf("compress %v: stream decryption mismatch for %d bytes", compress, count)
+			}
+			if got, err = e.Decrypt(dst); err != nil || !bytes.Equal(got, src) {
+				t.Errorf("compress %v: Decrypt() of %d bytes stream: mismatch or error %v", compress, count, err)
+			}
+		}
+	}
+}
+
+func TestStreamOtherFormats(t *testing.T) {
+	e, err := New("this is a passphrase", WithLegacyCBC(true))
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := getBytes(1000)
+	dst, err := e.Encrypt(src)
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	for desc, data := range map[string][]byte{
+		"header":     dst,
+		"legacy CBC": encryptCBC(e.(*encryption), src),
+	} {
+		got, err := decryptStream(e, data)
+		if err != nil {
+			t.Errorf("%s: decrypting: %v", desc, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%s: stream decryption mismatch", desc)
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	e, err := New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := getBytes(2*ChunkSize + 100)
+	dst := encryptStream(t, e, src)
+	chunk := ChunkSize + e.(*encryption).write.aead.Overhead()
+	start := len(e.(*encryption).header(versionStream).marshal())
+	for desc, data := range map[string][]byte{
+		"empty":                nil,
+		"header only":          dst[:start],
+		"truncated prefix":     dst[:start+prefixSize-1],
+		"no chunks":            dst[:start+prefixSize],
+		"truncated after one":  dst[:start+prefixSize+chunk],
+		"truncated after two":  dst[:start+prefixSize+2*chunk],
+		"truncated last chunk": dst[:len(dst)-1],
+		"dropped chunk":        append(append([]byte{}, dst[:start+prefixSize+chunk]...), dst[start+prefixSize+2*chunk:]...),
+		"swapped chunks": append(append(append([]byte{}, dst[:start+prefixSize]...),
+			dst[start+prefixSize+chunk:start+prefixSize+2*chunk]...),
+			dst[start+prefixSize:start+prefixSize+chunk]...),
+		"flipped byte": func() []byte {
+			d := append([]byte{}, dst...)
+			d[start+prefixSize+chunk+10] ^= 1
+			return d
+		}(),
+	} {
+		if _, err := decryptStream(e, data); err == nil {
+			t.Errorf("%s: want error, got nil", desc)
+		}
+	}
+}
+
+func TestEncryptReader(t *testing.T) {
+	e, err := New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("could not initialize encryption: %v", err)
+	}
+	src := getBytes(3*ChunkSize + 1)
+	r := EncryptReader(e, bytes.NewReader(src))
+	dst, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading ciphertext: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+	got, err := decryptStream(e, dst)
+	if err != nil {
+		t.Errorf("decrypting: %v", err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Errorf("EncryptReader() mismatch")
+	}
+
+	// Closing early should not leave the encryption blocked.
+	r = EncryptReader(e, bytes.NewReader(src))
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Save dumps m to filename atomically, through a temporary file in the same
+// directory renamed once complete.
+func Save(m Manifest, filename string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = m.Dump(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Open loads a manifest saved with Save.
+func Open(filename string, include, exclude []string) (Manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := New(include, exclude)
+	if err := m.Load(f); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Newest returns the most recently saved of the given manifests, ignoring the
+// nil ones. It returns nil if all are.
+func Newest(ms ...Manifest) Manifest {
+	var res Manifest
+	for _, m := range ms {
+		if m != nil && (res == nil || m.Saved().After(res.Saved())) {
+			res = m
+		}
+	}
+	return res
+}
@@ -0,0 +1,88 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSaveOpen(t *testing.T) {
+	oldReadDir, oldOpenFile, oldNow := readDir, openFile, now
+	defer func() {
+		readDir, openFile, now = oldReadDir, oldOpenFile, oldNow
+	}()
+	saved := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	now = func() time.Time { return saved }
+	fs := fileSystem{
+		"/root": dirOrFile{files: []dirOrFile{
+			{file: file{name: "f1", mod: saved, bytes: []byte{1}}},
+		}},
+	}
+	fs.init()
+	readDir, openFile = fs.readDir, fs.openFile
+
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "manifest")
+	if _, err := Open(fn, nil, nil); !os.IsNotExist(err) {
+		t.Errorf("Open(%q) of missing file want not exist error, got %v", fn, err)
+	}
+
+	m := New(nil, nil)
+	if _, err := m.Update("/root"); err != nil {
+		t.Fatalf("m.Update(/root) failed: %v", err)
+	}
+	if !m.Saved().IsZero() {
+		t.Errorf("m.Saved() before Save want zero, got %v", m.Saved())
+	}
+	for i := 0; i < 2; i++ {
+		if err := Save(m, fn); err != nil {
+			t.Fatalf("Save(%q) failed: %v", fn, err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Errorf("Save(%q) left files %v (error %v)", fn, files, err)
+	}
+	loaded, err := Open(fn, nil, nil)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", fn, err)
+	}
+	if !loaded.Saved().Equal(saved) {
+		t.Errorf("loaded.Saved() want %v, got %v", saved, loaded.Saved())
+	}
+	if !reflect.DeepEqual(loaded.(*index).Data, m.(*index).Data) {
+		t.Errorf("Open(%q) want data %v, got %v", fn, m.(*index).Data, loaded.(*index).Data)
+	}
+	if err := Save(m, filepath.Join(dir, "missing", "manifest")); err == nil {
+		t.Errorf("Save() in missing directory want error, got nil")
+	}
+}
+
+func TestNewest(t *testing.T) {
+	at := func(sec int64) Manifest {
+		return &index{SavedAt: time.Unix(sec, 0)}
+	}
+	older, newer := at(1), at(2)
+	for _, test := range []struct {
+		desc string
+		ms   []Manifest
+		want Manifest
+	}{
+		{"none", nil, nil},
+		{"all nil", []Manifest{nil, nil}, nil},
+		{"one", []Manifest{nil, older}, older},
+		{"newer first", []Manifest{newer, older}, newer},
+		{"newer last", []Manifest{older, nil, newer}, newer},
+	} {
+		if got := Newest(test.ms...); got != test.want {
+			t.Errorf("%s: Newest() want %v, got %v", test.desc, test.want, got)
+		}
+	}
+}
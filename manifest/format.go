@@ -0,0 +1,195 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+// The manifest is dumped as JSON lines: a header, followed by a line for each
+// file sorted by path. Times are in RFC 3339 format, in UTC, and hashes are
+// the hex encoded MD5 of the contents. For example:
+//
+//	{"docsync_manifest":1,"saved_at":"2021-01-02T12:00:00Z","include":[".*\\.pdf"]}
+//	{"path":"/home/me/docs/a.pdf","mod":"2021-01-02T11:00:00Z","hash":"...","size":1024}
+//
+// Fields are only added within a version, and left out when empty. Older
+// versions of docsync dumped the manifest with encoding/gob, which Load still
+// reads, so that saving it again migrates it.
+
+// FormatVersion is the version of the format written by Dump. Manifests in
+// newer versions are not loaded, as they may record more than understood.
+const FormatVersion = 1
+
+// header is the first line of a dumped manifest.
+type header struct {
+	Version int       `json:"docsync_manifest"`
+	SavedAt time.Time `json:"saved_at"`
+	// Include and Exclude are the patterns of the names of the files
+	// tracked, replacing those of the manifest when loaded.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// record is the line of a file in a dumped manifest, see Entry.
+type record struct {
+	Path     string          `json:"path"`
+	Mod      time.Time       `json:"mod"`
+	Hash     string          `json:"hash"`
+	Size     int64           `json:"size"`
+	Pending  bool            `json:"pending,omitempty"`
+	Object   string          `json:"object,omitempty"`
+	Stored   *versionRecord  `json:"stored,omitempty"`
+	From     string          `json:"from,omitempty"`
+	Versions []versionRecord `json:"versions,omitempty"`
+}
+
+// versionRecord is a Version in a dumped manifest.
+type versionRecord struct {
+	Name string    `json:"name,omitempty"`
+	Mod  time.Time `json:"mod"`
+	Hash string    `json:"hash"`
+	Size int64     `json:"size"`
+}
+
+func newVersionRecord(v Version) versionRecord {
+	return versionRecord{Name: v.Name, Mod: v.Mod.UTC(), Hash: hex.EncodeToString(v.Hash[:]), Size: v.Size}
+}
+
+func (r versionRecord) version() (Version, error) {
+	v := Version{Name: r.Name, Mod: r.Mod, Size: r.Size}
+	h, err := hex.DecodeString(r.Hash)
+	if err != nil || len(h) != md5.Size {
+		return Version{}, fmt.Errorf("invalid hash %q", r.Hash)
+	}
+	copy(v.Hash[:], h)
+	return v, nil
+}
+
+func newRecord(e Entry) record {
+	v := newVersionRecord(Version{Mod: e.Mod, Hash: e.Hash, Size: e.Size})
+	r := record{
+		Path:    e.Path,
+		Mod:     v.Mod,
+		Hash:    v.Hash,
+		Size:    v.Size,
+		Pending: e.Pending,
+		Object:  e.Object,
+		From:    e.From,
+	}
+	if e.Stored != nil {
+		stored := newVersionRecord(*e.Stored)
+		r.Stored = &stored
+	}
+	for _, v := range e.Versions {
+		r.Versions = append(r.Versions, newVersionRecord(v))
+	}
+	return r
+}
+
+func (r record) value() (value, error) {
+	if r.Path == "" {
+		return value{}, fmt.Errorf("file without path")
+	}
+	v, err := versionRecord{Mod: r.Mod, Hash: r.Hash, Size: r.Size}.version()
+	if err != nil {
+		return value{}, fmt.Errorf("%s: %v", r.Path, err)
+	}
+	res := value{Mod: v.Mod, Hash: v.Hash, Size: v.Size, Pending: r.Pending, Object: r.Object, From: r.From}
+	if r.Stored != nil {
+		stored, err := r.Stored.version()
+		if err != nil {
+			return value{}, fmt.Errorf("%s: stored: %v", r.Path, err)
+		}
+		res.Stored = &stored
+	}
+	for _, rv := range r.Versions {
+		v, err := rv.version()
+		if err != nil {
+			return value{}, fmt.Errorf("%s: version %s: %v", r.Path, rv.Name, err)
+		}
+		res.Versions = append(res.Versions, v)
+	}
+	return res, nil
+}
+
+func (i index) Dump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	h := header{
+		Version: FormatVersion,
+		SavedAt: now().UTC(),
+		Include: filtersForExport(i.include),
+		Exclude: filtersForExport(i.exclude),
+	}
+	if err := enc.Encode(h); err != nil {
+		return err
+	}
+	for _, e := range i.Entries() {
+		if err := enc.Encode(newRecord(e)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (i *index) Load(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	h := &header{}
+	if err := dec.Decode(h); err != nil {
+		// Dumped with encoding/gob by older versions.
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(i)
+		i.filtersForImport()
+		if err != nil {
+			return fmt.Errorf("not a manifest: %v", err)
+		}
+		return nil
+	}
+	switch {
+	case h.Version <= 0:
+		return fmt.Errorf("not a manifest: no format version")
+	case h.Version > FormatVersion:
+		return fmt.Errorf("manifest format version %d is newer than %d", h.Version, FormatVersion)
+	}
+	for _, pattern := range append(append([]string(nil), h.Include...), h.Exclude...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	files := make(map[string]value)
+	for {
+		rec := record{}
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		v, err := rec.value()
+		if err != nil {
+			return err
+		}
+		files[rec.Path] = v
+	}
+	i.SavedAt, i.Data = h.SavedAt, files
+	if len(h.Include) > 0 {
+		i.Include = h.Include
+	}
+	if len(h.Exclude) > 0 {
+		i.Exclude = h.Exclude
+	}
+	i.filtersForImport()
+	return nil
+}
@@ -0,0 +1,127 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpFormat(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	saved := time.Date(2021, 1, 2, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return saved }
+
+	mod := time.Date(2021, 1, 2, 11, 0, 0, 0, time.FixedZone("CET", 3600))
+	m := New([]string{`.*\.pdf`}, nil)
+	m.(*index).Data["/docs/a&b.pdf"] = value{Mod: mod, Hash: hash([]byte("a")), Size: 1}
+	m.(*index).Data["/docs/b.pdf"] = value{
+		Mod:      mod,
+		Hash:     hash([]byte("b")),
+		Size:     1,
+		Pending:  true,
+		Stored:   &Version{Name: "blobs/0", Mod: mod, Hash: hash([]byte("a")), Size: 1},
+		From:     "/docs/a.pdf",
+		Versions: []Version{{Name: "blobs/1", Mod: mod, Hash: hash([]byte("c")), Size: 1}},
+	}
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		t.Fatalf("Dump() failed: %v", err)
+	}
+	want := `{"docsync_manifest":1,"saved_at":"2021-01-02T12:00:00Z","include":[".*\\.pdf"]}
+{"path":"/docs/a&b.pdf","mod":"2021-01-02T10:00:00Z","hash":"0cc175b9c0f1b6a831c399e269772661","size":1}
+{"path":"/docs/b.pdf","mod":"2021-01-02T10:00:00Z","hash":"92eb5ffee6ae2fec3ad71c777531578f","size":1,"pending":true,"stored":{"name":"blobs/0","mod":"2021-01-02T10:00:00Z","hash":"0cc175b9c0f1b6a831c399e269772661","size":1},"from":"/docs/a.pdf","versions":[{"name":"blobs/1","mod":"2021-01-02T10:00:00Z","hash":"4a8a08f09d37b73795649038408b5f33","size":1}]}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Dump() want\n%s\ngot\n%s", want, got)
+	}
+
+	loaded := New(nil, nil)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	// Times are loaded in UTC.
+	utc := mod.UTC()
+	wantData := map[string]value{
+		"/docs/a&b.pdf": {Mod: utc, Hash: hash([]byte("a")), Size: 1},
+		"/docs/b.pdf": {
+			Mod:      utc,
+			Hash:     hash([]byte("b")),
+			Size:     1,
+			Pending:  true,
+			Stored:   &Version{Name: "blobs/0", Mod: utc, Hash: hash([]byte("a")), Size: 1},
+			From:     "/docs/a.pdf",
+			Versions: []Version{{Name: "blobs/1", Mod: utc, Hash: hash([]byte("c")), Size: 1}},
+		},
+	}
+	if got := loaded.(*index).Data; !reflect.DeepEqual(got, wantData) {
+		t.Errorf("Load() want %+v, got %+v", wantData, got)
+	}
+	if got := filtersForExport(loaded.(*index).include); !reflect.DeepEqual(got, []string{`.*\.pdf`}) {
+		t.Errorf("Load() want include rules [.*\\.pdf], got %v", got)
+	}
+	if !loaded.Saved().Equal(saved) {
+		t.Errorf("loaded.Saved() want %v, got %v", saved, loaded.Saved())
+	}
+}
+
+func TestLoadGob(t *testing.T) {
+	// As dumped by older versions.
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	old := index{
+		SavedAt: mod,
+		Data:    map[string]value{"/docs/a.pdf": {Mod: mod, Hash: hash([]byte("a"))}},
+		Include: []string{`.*\.pdf`},
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(old); err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+	m := New(nil, nil)
+	if err := m.Load(&buf); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if !reflect.DeepEqual(m.(*index).Data, old.Data) || !m.Saved().Equal(mod) || !m.(*index).tracks("/docs/b.pdf") || m.(*index).tracks("/docs/b.txt") {
+		t.Errorf("Load() want %+v, got %+v", old, m)
+	}
+
+	// Dumped again in the current format.
+	buf.Reset()
+	if err := m.Dump(&buf); err != nil {
+		t.Fatalf("Dump() failed: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"docsync_manifest":1,`) {
+		t.Errorf("Dump() after Load() want the current format, got %q", buf.String())
+	}
+	loaded := New(nil, nil)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load() of migrated manifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Entries(), m.Entries()) {
+		t.Errorf("Load() of migrated manifest want %+v, got %+v", m.Entries(), loaded.Entries())
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	const file = `{"path":"/docs/a.pdf","mod":"2021-01-02T10:00:00Z","hash":"0cc175b9c0f1b6a831c399e269772661","size":1}`
+	for _, test := range []struct {
+		desc string
+		data string
+	}{
+		{"newer version", `{"docsync_manifest":2}` + "\n" + file},
+		{"no version", `{"saved_at":"2021-01-02T12:00:00Z"}` + "\n" + file},
+		{"invalid pattern", `{"docsync_manifest":1,"include":["("]}`},
+		{"no path", `{"docsync_manifest":1}` + "\n" + strings.Replace(file, "/docs/a.pdf", "", 1)},
+		{"invalid hash", `{"docsync_manifest":1}` + "\n" + strings.Replace(file, "0cc1", "", 1)},
+		{"invalid version hash", `{"docsync_manifest":1}` + "\n" + strings.Replace(file, `"size":1}`, `"size":1,"versions":[{"hash":"x"}]}`, 1)},
+		{"truncated", `{"docsync_manifest":1}` + "\n" + file[:20]},
+		{"garbage", "not a manifest"},
+	} {
+		if err := New(nil, nil).Load(strings.NewReader(test.data)); err == nil {
+			t.Errorf("%s: Load() want error, got nil", test.desc)
+		}
+	}
+}
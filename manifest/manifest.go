@@ -4,36 +4,154 @@ package manifest
 
 import (
 	"crypto/md5"
-	"encoding/gob"
 	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
 )
 
 type value struct {
 	Mod  time.Time
 	Hash [md5.Size]byte
+	Size int64
+	// Pending is set for changes found by Diff until they are committed.
+	Pending bool
+	// Object holds the contents of files stored by content.
+	Object string
+	// Stored is the committed state of a pending file, when it was modified.
+	Stored *Version
+	// From is the path a pending file was renamed from.
+	From string
+	// Versions kept of the file, oldest first.
+	Versions []Version
 }
 type index struct {
+	// SavedAt is when the manifest was dumped.
+	SavedAt time.Time
 	Data    map[string]value
+	// Include and Exclude are the patterns of include and exclude, exported
+	// for manifests dumped with encoding/gob, see Load.
 	Include []string
 	Exclude []string
 	include []*regexp.Regexp
 	exclude []*regexp.Regexp
 }
 
+// Kind of change to a file.
+type Kind int
+
+// Kinds of changes reported by Diff.
+const (
+	// Added files were not in the manifest.
+	Added Kind = iota
+	// Modified files have a different modification time than recorded.
+	Modified
+	// Removed files are in the manifest but no longer on disk.
+	Removed
+	// Renamed files were not in the manifest, but have the contents of a
+	// file removed in the same Diff, see Change.From.
+	Renamed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Removed:
+		return "removed"
+	case Renamed:
+		return "renamed"
+	}
+	return "unknown"
+}
+
+// Entry is a file recorded in the manifest.
+type Entry struct {
+	Path string
+	// Mod is the modification time of the file when recorded.
+	Mod time.Time
+	// Hash is the MD5 of the contents of the file.
+	Hash [md5.Size]byte
+	// Size of the file, zero for files recorded by older versions.
+	Size int64
+	// Pending is set until the change is committed, see Diff.
+	Pending bool
+	// Object is the name of the object holding the contents of files stored
+	// by content, see CommitObject. It is empty for files stored under their
+	// path, and for pending files.
+	Object string
+	// Stored is the state of the file when last committed, set for pending
+	// files which were modified or renamed since.
+	Stored *Version
+	// From is the path a pending file was renamed from, whose remote copy
+	// still holds its contents.
+	From string
+	// Versions kept of the file, oldest first, see SetVersions.
+	Versions []Version
+}
+
+// Version is a previous version of a file, kept in storage.
+type Version struct {
+	// Name of the version in storage. For the committed state of pending
+	// files, see Entry.Stored, it is set only for files stored by content.
+	Name string
+	Mod  time.Time
+	Hash [md5.Size]byte
+	Size int64
+}
+
+// Change is a change to a file found by Diff.
+type Change struct {
+	Path string
+	Kind Kind
+	// Object held the contents of removed files stored by content.
+	Object string
+	// Mod is the modification time of the remote copy of removed files.
+	Mod time.Time
+	// From is the previous path of renamed files.
+	From string
+}
+
 // Manifest provides the interface for monitoring changes on a directory.
 type Manifest interface {
 	// Update tracks changes in the given directory.
 	Update(dir string) (changed []string, err error)
-	// Dump allows serialization of the manifest state.
+	// Diff is like Update for all the given directories, but reports the kind
+	// of the changes, including the files removed from the directories, which
+	// are forgotten. New files with the same size and hash as a removed file
+	// are reported as renamed from it, keeping its versions. Added, modified
+	// and renamed files are pending, and reported again by the next calls,
+	// until they are committed.
+	Diff(dirs ...string) ([]Change, error)
+	// Commit marks the changes to path as synced.
+	Commit(path string)
+	// CommitObject is Commit for files stored by content, in the object
+	// named object.
+	CommitObject(path, object string)
+	// Pending returns the paths of the changes not yet committed, sorted.
+	Pending() []string
+	// Entries returns the files in the manifest, sorted by path.
+	Entries() []Entry
+	// Lookup returns the file path in the manifest, if found.
+	Lookup(path string) (Entry, bool)
+	// SetVersions records the versions kept of path, which are forgotten
+	// along with the file when it is removed.
+	SetVersions(path string, versions []Version)
+	// Dump allows serialization of the manifest state, in the format
+	// documented in format.go.
 	Dump(io.Writer) error
-	// Load allows deserialization of a manifest state in the current object.
+	// Load allows deserialization of a manifest state in the current object,
+	// dumped in any version of the format or with encoding/gob.
 	Load(io.Reader) error
+	// Saved returns when the loaded state was dumped, or the zero time.
+	Saved() time.Time
 }
 
 // New creates a manifest with the provided include/exclude rules.
@@ -56,11 +174,6 @@ func filtersForExport(f []*regexp.Regexp) []string {
 	return res
 }
 
-func (i *index) filtersForExport() {
-	i.Include = filtersForExport(i.include)
-	i.Exclude = filtersForExport(i.exclude)
-}
-
 func filtersForImport(f []string) []*regexp.Regexp {
 	var res []*regexp.Regexp
 	for _, e := range f {
@@ -77,19 +190,30 @@ func (i *index) filtersForImport() {
 var (
 	// For faking in tests.
 	readDir  = ioutil.ReadDir
-	readFile = ioutil.ReadFile
-	hash     = md5.Sum
+	openFile = func(fn string) (io.ReadCloser, error) { return os.Open(fn) }
+	now      = time.Now
 )
 
-func (i index) Dump(w io.Writer) error {
-	i.filtersForExport()
-	return gob.NewEncoder(w).Encode(i)
+// hashFile returns the MD5 hash and the size of fn, reading it in chunks so
+// that large files are not held in memory.
+func hashFile(fn string) ([md5.Size]byte, int64, error) {
+	var sum [md5.Size]byte
+	f, err := openFile(fn)
+	if err != nil {
+		return sum, 0, err
+	}
+	defer f.Close()
+	h := md5.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return sum, 0, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, n, nil
 }
 
-func (i *index) Load(r io.Reader) error {
-	err := gob.NewDecoder(r).Decode(i)
-	i.filtersForImport()
-	return err
+func (i index) Saved() time.Time {
+	return i.SavedAt
 }
 
 func matchesAny(s string, res []*regexp.Regexp) bool {
@@ -113,44 +237,258 @@ func (i index) tracks(filepath string) bool {
 }
 
 func (i index) Update(d string) ([]string, error) {
+	changes, err := i.update(d, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, c := range changes {
+		res = append(res, c.Path)
+	}
+	return res, nil
+}
+
+func (i index) Diff(dirs ...string) ([]Change, error) {
+	var prefixes []string
+	for _, d := range dirs {
+		prefixes = append(prefixes, strings.TrimSuffix(path.Clean(d), "/")+"/")
+	}
+	seen := make(map[string]bool)
+	var changes []Change
+	for n, d := range dirs {
+		if enclosed(prefixes, n) {
+			// Scanned with the enclosing directory, or already.
+			continue
+		}
+		new, err := i.update(d, seen, true)
+		if err != nil {
+			// Files in unreadable directories are not removed.
+			return nil, err
+		}
+		changes = append(changes, new...)
+	}
+	removed := make(map[string]value)
+	var gone []string
+	for fn, v := range i.Data {
+		if within(fn, prefixes) && !seen[fn] {
+			removed[fn] = v
+			gone = append(gone, fn)
+			delete(i.Data, fn)
+		}
+	}
+	sort.Strings(gone)
+	sort.Slice(changes, func(a, b int) bool { return changes[a].Path < changes[b].Path })
+	var removals []Change
+	for n, c := range changes {
+		v := i.Data[c.Path]
+		if c.Kind == Modified && v.From != "" {
+			// Renamed by an earlier Diff.
+			_, back := i.Data[v.From]
+			if !back && v.Hash == v.Stored.Hash {
+				changes[n] = Change{Path: c.Path, Kind: Renamed, From: v.From}
+				continue
+			}
+			// Modified since, or another file took the previous path:
+			// the remote copy no longer belongs to the file.
+			if !back {
+				removals = append(removals, Change{Path: v.From, Kind: Removed, Object: v.Stored.Name, Mod: v.Stored.Mod})
+			}
+			if v.Stored.Name == "" {
+				v.Stored = nil
+			}
+			v.From = ""
+			i.Data[c.Path] = v
+		}
+		if c.Kind != Added {
+			continue
+		}
+		for _, fn := range gone {
+			old, found := removed[fn]
+			// Pending files may not be in storage, or not with the
+			// contents recorded.
+			if !found || old.Pending || old.Hash != v.Hash || old.Size != v.Size {
+				continue
+			}
+			delete(removed, fn)
+			v.Stored = &Version{Name: old.Object, Mod: old.Mod, Hash: old.Hash, Size: old.Size}
+			v.Versions = old.Versions
+			v.From = fn
+			i.Data[c.Path] = v
+			changes[n] = Change{Path: c.Path, Kind: Renamed, From: fn}
+			break
+		}
+	}
+	for _, fn := range gone {
+		if v, found := removed[fn]; found {
+			removals = append(removals, removal(fn, v))
+		}
+	}
+	changes = append(changes, removals...)
+	sort.Slice(changes, func(a, b int) bool { return changes[a].Path < changes[b].Path })
+	return changes, nil
+}
+
+// within reports whether fn is within any of the directories with the given
+// prefixes.
+func within(fn string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(fn, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// enclosed reports whether the directory with the nth of prefixes is within
+// another one, or the same as one before it.
+func enclosed(prefixes []string, n int) bool {
+	for m, prefix := range prefixes {
+		if m != n && strings.HasPrefix(prefixes[n], prefix) && (m < n || prefix != prefixes[n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// removal returns the change removing the file fn, recorded as v.
+func removal(fn string, v value) Change {
+	c := Change{Path: fn, Kind: Removed, Object: v.Object, Mod: v.Mod}
+	if v.Stored != nil {
+		c.Object, c.Mod = v.Stored.Name, v.Stored.Mod
+	}
+	return c
+}
+
+func (i index) Commit(fn string) {
+	i.CommitObject(fn, "")
+}
+
+func (i index) CommitObject(fn, object string) {
+	if v, found := i.Data[fn]; found {
+		v.Pending = false
+		v.Object = object
+		v.Stored = nil
+		v.From = ""
+		i.Data[fn] = v
+	}
+}
+
+func (i index) Pending() []string {
+	var res []string
+	for fn, v := range i.Data {
+		if v.Pending {
+			res = append(res, fn)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (i index) Entries() []Entry {
+	var res []Entry
+	for fn, v := range i.Data {
+		res = append(res, entry(fn, v))
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Path < res[b].Path })
+	return res
+}
+
+func (i index) Lookup(fn string) (Entry, bool) {
+	v, found := i.Data[fn]
+	if !found {
+		return Entry{}, false
+	}
+	return entry(fn, v), true
+}
+
+func entry(fn string, v value) Entry {
+	e := Entry{
+		Path:     fn,
+		Mod:      v.Mod,
+		Hash:     v.Hash,
+		Size:     v.Size,
+		Pending:  v.Pending,
+		Object:   v.Object,
+		From:     v.From,
+		Versions: append([]Version(nil), v.Versions...),
+	}
+	if v.Stored != nil {
+		stored := *v.Stored
+		e.Stored = &stored
+	}
+	return e
+}
+
+func (i index) SetVersions(fn string, versions []Version) {
+	if v, found := i.Data[fn]; found {
+		v.Versions = append([]Version(nil), versions...)
+		i.Data[fn] = v
+	}
+}
+
+// update records the changes in d, sorted by path, and adds all the files in d
+// to seen if not nil. The changes are recorded as pending if requested, and
+// pending files are reported as changed.
+func (i index) update(d string, seen map[string]bool, pending bool) ([]Change, error) {
 	files, err := readDir(d)
 	if err != nil {
 		return nil, err
 	}
-	changed := make(map[string]bool)
+	changed := make(map[string]Kind)
 	for _, f := range files {
 		fn := path.Join(d, f.Name())
 		if f.IsDir() {
-			new, err := i.Update(fn)
+			new, err := i.update(fn, seen, pending)
 			if err != nil {
 				return nil, err
 			}
-			for _, fc := range new {
-				changed[fc] = true
+			for _, c := range new {
+				changed[c.Path] = c.Kind
 			}
 			continue
 		}
-		if v, found := i.Data[fn]; found && f.ModTime().Equal(v.Mod) {
+		if seen != nil {
+			seen[fn] = true
+		}
+		v, found := i.Data[fn]
+		if found && f.ModTime().Equal(v.Mod) && !v.Pending {
 			continue
 		}
 		if !i.tracks(fn) {
 			continue
 		}
-		bytes, err := readFile(fn)
+		sum, size, err := hashFile(fn)
 		if err != nil {
 			log.Printf("Could not read %s: %v\n", fn, err)
 			continue
 		}
-		changed[fn] = true
-		i.Data[fn] = value{
-			Mod:  f.ModTime(),
-			Hash: hash(bytes),
+		if _, dup := changed[fn]; !dup {
+			changed[fn] = Added
+			if found {
+				changed[fn] = Modified
+			}
+		}
+		next := value{
+			Mod:      f.ModTime(),
+			Hash:     sum,
+			Size:     size,
+			Pending:  pending,
+			Versions: v.Versions,
+		}
+		// The committed state is what storage holds until the change is
+		// committed.
+		if found && pending {
+			next.Stored, next.From = v.Stored, v.From
+			if !v.Pending {
+				next.Stored = &Version{Name: v.Object, Mod: v.Mod, Hash: v.Hash, Size: v.Size}
+			}
 		}
+		i.Data[fn] = next
 	}
-	var res []string
-	for k := range changed {
-		res = append(res, k)
+	var res []Change
+	for fn, kind := range changed {
+		res = append(res, Change{Path: fn, Kind: kind})
 	}
-	sort.Strings(res)
+	sort.Slice(res, func(a, b int) bool { return res[a].Path < res[b].Path })
 	return res, nil
 }
@@ -2,7 +2,10 @@ package manifest
 
 import (
 	"bytes"
+	"crypto/md5"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
@@ -87,7 +90,7 @@ func (f fileSystem) readDir(fn string) ([]os.FileInfo, error) {
 	return ret, nil
 }
 
-func (f fileSystem) readFile(fn string) ([]byte, error) {
+func (f fileSystem) openFile(fn string) (io.ReadCloser, error) {
 	if strings.Contains(fn, "with-error") {
 		return nil, fmt.Errorf("error reading %q", fn)
 	}
@@ -98,13 +101,15 @@ func (f fileSystem) readFile(fn string) ([]byte, error) {
 	if len(dof.bytes) == 0 {
 		return nil, fmt.Errorf("permission denied %q", fn)
 	}
-	return dof.bytes, nil
+	return ioutil.NopCloser(bytes.NewReader(dof.bytes)), nil
 }
 
+var hash = md5.Sum
+
 func TestManifestUpdates(t *testing.T) {
-	oldReadDir, oldReadFile := readDir, readFile
+	oldReadDir, oldOpenFile := readDir, openFile
 	defer func() {
-		readDir, readFile = oldReadDir, oldReadFile
+		readDir, openFile = oldReadDir, oldOpenFile
 	}()
 	now := time.Now()
 	for _, test := range []struct {
@@ -176,7 +181,7 @@ func TestManifestUpdates(t *testing.T) {
 		true,
 	}} {
 		test.fs.init()
-		readDir, readFile = test.fs.readDir, test.fs.readFile
+		readDir, openFile = test.fs.readDir, test.fs.openFile
 		m := New(nil, nil)
 		changed, err := m.Update(test.dir)
 		if test.err != (err != nil) {
@@ -189,9 +194,9 @@ func TestManifestUpdates(t *testing.T) {
 }
 
 func TestManifestDumpLoad(t *testing.T) {
-	oldReadDir, oldReadFile := readDir, readFile
+	oldReadDir, oldOpenFile := readDir, openFile
 	defer func() {
-		readDir, readFile = oldReadDir, oldReadFile
+		readDir, openFile = oldReadDir, oldOpenFile
 	}()
 	fs := fileSystem{
 		"/root": dirOrFile{
@@ -204,7 +209,7 @@ func TestManifestDumpLoad(t *testing.T) {
 		},
 	}
 	fs.init()
-	readDir, readFile = fs.readDir, fs.readFile
+	readDir, openFile = fs.readDir, fs.openFile
 	m := New([]string{"sample-\\d{2}"}, []string{"\\.excluded", ".*.excl"})
 	changed, err := m.Update("/root")
 	want := []string{"/root/sample-00", "/root/sample-01"}
@@ -225,3 +230,330 @@ func TestManifestDumpLoad(t *testing.T) {
 		t.Errorf("newM.Update(/root) want (%v, nil) got (%v, %v)", want, changed, err)
 	}
 }
+
+func TestManifestDiff(t *testing.T) {
+	oldReadDir, oldOpenFile := readDir, openFile
+	defer func() {
+		readDir, openFile = oldReadDir, oldOpenFile
+	}()
+	now := time.Now()
+	before := fileSystem{
+		"/root": dirOrFile{files: []dirOrFile{
+			{file: file{name: "kept", mod: now, bytes: []byte{1}}},
+			{file: file{name: "modified", mod: now, bytes: []byte{2}}},
+			{file: file{name: "removed", mod: now, bytes: []byte{3}}},
+			{file: file{name: "d1"}, files: []dirOrFile{
+				{file: file{name: "removed", mod: now, bytes: []byte{4}}},
+			}},
+		}},
+		"/other": dirOrFile{files: []dirOrFile{
+			{file: file{name: "untouched", mod: now, bytes: []byte{5}}},
+		}},
+	}
+	after := fileSystem{
+		"/root": dirOrFile{files: []dirOrFile{
+			{file: file{name: "kept", mod: now, bytes: []byte{1}}},
+			{file: file{name: "modified", mod: now.Add(time.Second), bytes: []byte{2, 2}}},
+			{file: file{name: "added", mod: now, bytes: []byte{6}}},
+		}},
+		"/other": dirOrFile{files: []dirOrFile{
+			{file: file{name: "untouched", mod: now, bytes: []byte{5}}},
+		}},
+		"/root-error": dirOrFile{files: []dirOrFile{
+			{file: file{name: "error-dir"}, files: []dirOrFile{
+				{file: file{name: "unreachable"}},
+			}},
+		}},
+	}
+	before.init()
+	after.init()
+	m := New(nil, nil)
+	readDir, openFile = before.readDir, before.openFile
+	for _, dir := range []string{"/root", "/other"} {
+		changes, err := m.Diff(dir)
+		if err != nil {
+			t.Fatalf("m.Diff(%q) failed: %v", dir, err)
+		}
+		for _, c := range changes {
+			m.Commit(c.Path)
+		}
+	}
+	readDir, openFile = after.readDir, after.openFile
+	changes, err := m.Diff("/root")
+	if err != nil {
+		t.Fatalf("m.Diff(/root) failed: %v", err)
+	}
+	want := []Change{
+		{Path: "/root/added", Kind: Added},
+		{Path: "/root/d1/removed", Kind: Removed, Mod: now},
+		{Path: "/root/modified", Kind: Modified},
+		{Path: "/root/removed", Kind: Removed, Mod: now},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("m.Diff(/root) want %v, got %v", want, changes)
+	}
+	for _, c := range changes {
+		m.Commit(c.Path)
+	}
+	for _, dir := range []string{"/root", "/other"} {
+		if changes, err := m.Diff(dir); err != nil || len(changes) != 0 {
+			t.Errorf("m.Diff(%q) again want no changes, got (%v, %v)", dir, changes, err)
+		}
+	}
+	if _, found := m.(*index).Data["/root/removed"]; found {
+		t.Errorf("m.Diff(/root) did not forget /root/removed")
+	}
+
+	m.(*index).Data["/root-error/error-dir/unreachable"] = value{Mod: now}
+	if _, err := m.Diff("/root-error"); err == nil {
+		t.Errorf("m.Diff(/root-error) want error, got nil")
+	}
+	if _, found := m.(*index).Data["/root-error/error-dir/unreachable"]; !found {
+		t.Errorf("m.Diff(/root-error) forgot a file in an unreadable directory")
+	}
+}
+
+func TestManifestRenames(t *testing.T) {
+	oldReadDir, oldOpenFile := readDir, openFile
+	defer func() {
+		readDir, openFile = oldReadDir, oldOpenFile
+	}()
+	now := time.Now()
+	change := func(files ...dirOrFile) {
+		fs := fileSystem{"/root": dirOrFile{files: files}}
+		fs.init()
+		readDir, openFile = fs.readDir, fs.openFile
+	}
+	change(
+		dirOrFile{file: file{name: "a", mod: now, bytes: []byte{1}}},
+		dirOrFile{file: file{name: "b", mod: now, bytes: []byte{2}}},
+		dirOrFile{file: file{name: "pending", mod: now, bytes: []byte{3}}},
+		dirOrFile{file: file{name: "d1"}, files: []dirOrFile{
+			{file: file{name: "x", mod: now, bytes: []byte{4}}},
+		}},
+	)
+	m := New(nil, nil)
+	if _, err := m.Diff("/root"); err != nil {
+		t.Fatalf("m.Diff(/root) failed: %v", err)
+	}
+	m.Commit("/root/a")
+	m.Commit("/root/b")
+	m.CommitObject("/root/d1/x", "blobs/x")
+	versions := []Version{{Name: "versions/a", Mod: now.Add(-time.Hour), Hash: hash([]byte{0}), Size: 1}}
+	m.SetVersions("/root/a", versions)
+
+	later := now.Add(time.Minute)
+	change(
+		dirOrFile{file: file{name: "b2", mod: later, bytes: []byte{2, 2}}},
+		dirOrFile{file: file{name: "pending2", mod: later, bytes: []byte{3}}},
+		dirOrFile{file: file{name: "x1", mod: later, bytes: []byte{4}}},
+		dirOrFile{file: file{name: "x2", mod: later, bytes: []byte{4}}},
+		dirOrFile{file: file{name: "d2"}, files: []dirOrFile{
+			{file: file{name: "a", mod: later, bytes: []byte{1}}},
+		}},
+	)
+	// Directories within others are scanned once.
+	changes, err := m.Diff("/root/d2", "/root", "/root")
+	if err != nil {
+		t.Fatalf("m.Diff(/root/d2, /root) failed: %v", err)
+	}
+	want := []Change{
+		{Path: "/root/b", Kind: Removed, Mod: now},
+		{Path: "/root/b2", Kind: Added},
+		{Path: "/root/d2/a", Kind: Renamed, From: "/root/a"},
+		{Path: "/root/pending", Kind: Removed, Mod: now},
+		{Path: "/root/pending2", Kind: Added},
+		{Path: "/root/x1", Kind: Renamed, From: "/root/d1/x"},
+		{Path: "/root/x2", Kind: Added},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("m.Diff(/root/d2, /root) want %v, got %v", want, changes)
+	}
+	stored := &Version{Mod: now, Hash: hash([]byte{1}), Size: 1}
+	if e, _ := m.Lookup("/root/d2/a"); !e.Pending || e.From != "/root/a" || !reflect.DeepEqual(e.Stored, stored) || !reflect.DeepEqual(e.Versions, versions) {
+		t.Errorf("m.Lookup(/root/d2/a) want pending from /root/a, stored %+v and versions %+v, got %+v", stored, versions, e)
+	}
+
+	// Renamed files are reported until committed, while unchanged.
+	m.Commit("/root/b2")
+	m.Commit("/root/pending2")
+	m.Commit("/root/x2")
+	changes, err = m.Diff("/root")
+	if err != nil {
+		t.Fatalf("m.Diff(/root) failed: %v", err)
+	}
+	want = []Change{
+		{Path: "/root/d2/a", Kind: Renamed, From: "/root/a"},
+		{Path: "/root/x1", Kind: Renamed, From: "/root/d1/x"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("m.Diff(/root) again want %v, got %v", want, changes)
+	}
+	latest := later.Add(time.Minute)
+	change(
+		dirOrFile{file: file{name: "a", mod: latest, bytes: []byte{5}}},
+		dirOrFile{file: file{name: "b2", mod: later, bytes: []byte{2, 2}}},
+		dirOrFile{file: file{name: "pending2", mod: later, bytes: []byte{3}}},
+		dirOrFile{file: file{name: "x1", mod: latest, bytes: []byte{6}}},
+		dirOrFile{file: file{name: "x2", mod: later, bytes: []byte{4}}},
+		dirOrFile{file: file{name: "d2"}, files: []dirOrFile{
+			{file: file{name: "a", mod: later, bytes: []byte{1}}},
+		}},
+	)
+	changes, err = m.Diff("/root")
+	if err != nil {
+		t.Fatalf("m.Diff(/root) failed: %v", err)
+	}
+	want = []Change{
+		{Path: "/root/a", Kind: Added},
+		{Path: "/root/d1/x", Kind: Removed, Object: "blobs/x", Mod: now},
+		{Path: "/root/d2/a", Kind: Modified},
+		{Path: "/root/x1", Kind: Modified},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("m.Diff(/root) after changes want %v, got %v", want, changes)
+	}
+	// The remote copies of the previous paths no longer hold the contents.
+	if e, _ := m.Lookup("/root/d2/a"); e.From != "" || e.Stored != nil {
+		t.Errorf("m.Lookup(/root/d2/a) want no longer renamed, got %+v", e)
+	}
+	stored = &Version{Name: "blobs/x", Mod: now, Hash: hash([]byte{4}), Size: 1}
+	if e, _ := m.Lookup("/root/x1"); e.From != "" || !reflect.DeepEqual(e.Stored, stored) {
+		t.Errorf("m.Lookup(/root/x1) want no longer renamed, stored %+v, got %+v", stored, e)
+	}
+}
+
+func TestManifestPending(t *testing.T) {
+	oldReadDir, oldOpenFile := readDir, openFile
+	defer func() {
+		readDir, openFile = oldReadDir, oldOpenFile
+	}()
+	now := time.Now()
+	fs := fileSystem{
+		"/root": dirOrFile{files: []dirOrFile{
+			{file: file{name: "f1", mod: now, bytes: []byte{1}}},
+			{file: file{name: "f2", mod: now, bytes: []byte{2}}},
+		}},
+	}
+	fs.init()
+	readDir, openFile = fs.readDir, fs.openFile
+	m := New(nil, nil)
+	want := []Change{{Path: "/root/f1", Kind: Added}, {Path: "/root/f2", Kind: Added}}
+	if changes, err := m.Diff("/root"); err != nil || !reflect.DeepEqual(changes, want) {
+		t.Fatalf("m.Diff(/root) want (%v, nil), got (%v, %v)", want, changes, err)
+	}
+	if got, want := m.Pending(), []string{"/root/f1", "/root/f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("m.Pending() want %v, got %v", want, got)
+	}
+	// Only f1 was uploaded successfully.
+	m.Commit("/root/f1")
+	m.Commit("/root/unknown")
+	if got, want := m.Pending(), []string{"/root/f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("m.Pending() after Commit want %v, got %v", want, got)
+	}
+
+	// The pending state survives Dump and Load.
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		t.Fatalf("Dump want nil, got error %v", err)
+	}
+	m = New(nil, nil)
+	if err := m.Load(&buf); err != nil {
+		t.Fatalf("Load want nil, got error %v", err)
+	}
+	want = []Change{{Path: "/root/f2", Kind: Modified}}
+	if changes, err := m.Diff("/root"); err != nil || !reflect.DeepEqual(changes, want) {
+		t.Errorf("m.Diff(/root) after Load want (%v, nil), got (%v, %v)", want, changes, err)
+	}
+	entries := m.Entries()
+	if len(entries) != 2 || entries[0].Path != "/root/f1" || entries[0].Pending || entries[1].Path != "/root/f2" || !entries[1].Pending {
+		t.Errorf("m.Entries() want /root/f1 committed and /root/f2 pending, got %+v", entries)
+	}
+	if want := hash([]byte{2}); entries[1].Hash != want || !entries[1].Mod.Equal(now) || entries[1].Size != 1 {
+		t.Errorf("m.Entries() want /root/f2 with hash %x, time %v and size 1, got %+v", want, now, entries[1])
+	}
+	// Update records changes as synced right away.
+	if changed, err := m.Update("/root"); err != nil || !reflect.DeepEqual(changed, []string{"/root/f2"}) {
+		t.Errorf("m.Update(/root) want ([/root/f2], nil), got (%v, %v)", changed, err)
+	}
+	if got := m.Pending(); len(got) != 0 {
+		t.Errorf("m.Pending() after Update want none, got %v", got)
+	}
+}
+
+func TestManifestVersions(t *testing.T) {
+	oldReadDir, oldOpenFile := readDir, openFile
+	defer func() {
+		readDir, openFile = oldReadDir, oldOpenFile
+	}()
+	first := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	change := func(mod time.Time, contents byte) {
+		fs := fileSystem{
+			"/root": dirOrFile{files: []dirOrFile{
+				{file: file{name: "f1", mod: mod, bytes: []byte{contents}}},
+			}},
+		}
+		fs.init()
+		readDir, openFile = fs.readDir, fs.openFile
+	}
+	change(first, 1)
+	m := New(nil, nil)
+	if _, err := m.Diff("/root"); err != nil {
+		t.Fatalf("m.Diff(/root) want nil, got error %v", err)
+	}
+	if e, found := m.Lookup("/root/f1"); !found || e.Stored != nil {
+		t.Errorf("m.Lookup(/root/f1) of added file want no stored version, got (%+v, %v)", e, found)
+	}
+	m.CommitObject("/root/f1", "blobs/1")
+	if e, _ := m.Lookup("/root/f1"); e.Object != "blobs/1" || e.Pending {
+		t.Errorf("m.Lookup(/root/f1) after CommitObject want object blobs/1, got %+v", e)
+	}
+
+	// Storage holds the first contents until the changes are committed.
+	want := &Version{Name: "blobs/1", Mod: first, Hash: hash([]byte{1}), Size: 1}
+	for i, mod := range []time.Time{first.Add(time.Hour), first.Add(2 * time.Hour)} {
+		change(mod, byte(i+2))
+		if _, err := m.Diff("/root"); err != nil {
+			t.Fatalf("m.Diff(/root) want nil, got error %v", err)
+		}
+		if e, _ := m.Lookup("/root/f1"); !reflect.DeepEqual(e.Stored, want) || e.Object != "" {
+			t.Errorf("m.Lookup(/root/f1) after change %d want stored version %+v and no object, got %+v", i, want, e)
+		}
+	}
+	versions := []Version{{Name: "versions/f1", Mod: first, Hash: hash([]byte{1}), Size: 1}}
+	m.SetVersions("/root/f1", versions)
+	m.SetVersions("/root/unknown", versions)
+	m.Commit("/root/f1")
+	if e, _ := m.Lookup("/root/f1"); e.Stored != nil || !reflect.DeepEqual(e.Versions, versions) {
+		t.Errorf("m.Lookup(/root/f1) after Commit want versions %+v and no stored version, got %+v", versions, e)
+	}
+	if _, found := m.Lookup("/root/unknown"); found {
+		t.Errorf("m.Lookup(/root/unknown) want not found")
+	}
+
+	// The versions survive Dump, Load and further changes.
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		t.Fatalf("Dump want nil, got error %v", err)
+	}
+	m = New(nil, nil)
+	if err := m.Load(&buf); err != nil {
+		t.Fatalf("Load want nil, got error %v", err)
+	}
+	change(first.Add(3*time.Hour), 4)
+	if _, err := m.Diff("/root"); err != nil {
+		t.Fatalf("m.Diff(/root) want nil, got error %v", err)
+	}
+	if e, _ := m.Lookup("/root/f1"); !reflect.DeepEqual(e.Versions, versions) || e.Stored == nil || e.Stored.Hash != hash([]byte{3}) {
+		t.Errorf("m.Lookup(/root/f1) after Load want versions %+v and the third contents stored, got %+v", versions, e)
+	}
+
+	// Removed files report the object holding their contents.
+	m.CommitObject("/root/f1", "blobs/4")
+	fs := fileSystem{"/root": dirOrFile{}}
+	readDir = fs.readDir
+	removed := []Change{{Path: "/root/f1", Kind: Removed, Object: "blobs/4", Mod: first.Add(3 * time.Hour)}}
+	if changes, err := m.Diff("/root"); err != nil || !reflect.DeepEqual(changes, removed) {
+		t.Errorf("m.Diff(/root) after removal want (%v, nil), got (%v, %v)", removed, changes, err)
+	}
+}
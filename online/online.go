@@ -0,0 +1,100 @@
+// Package online tracks whether a remote service, like the storage, is
+// reachable, so that work needing it can wait instead of failing.
+package online
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds each call of a Probe.
+const probeTimeout = 10 * time.Second
+
+// Probe returns an error if the service is not reachable, or a
+// *PermanentError if it refuses the requests.
+type Probe func(ctx context.Context) error
+
+// PermanentError is returned by a Probe when the service is reachable but
+// refuses the requests, for example for bad credentials, so that waiting for it
+// is pointless.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// HTTPProbe returns a Probe requesting url, where any response means the
+// service is reachable.
+func HTTPProbe(client *http.Client, url string) Probe {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+}
+
+// Lister is the part of storage.Storage needed by StorageProbe.
+type Lister interface {
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// StorageProbe returns a Probe listing the files starting with prefix, which
+// should be few. Errors for which rejected returns true are permanent.
+func StorageProbe(s Lister, prefix string, rejected func(error) bool) Probe {
+	return func(ctx context.Context) error {
+		_, err := s.List(ctx, prefix)
+		if err != nil && rejected(err) {
+			return &PermanentError{err}
+		}
+		return err
+	}
+}
+
+// Checker remembers whether a service was reachable.
+type Checker struct {
+	probe Probe
+
+	mu     sync.Mutex
+	online bool
+	// checked is false until the first probe.
+	checked bool
+}
+
+// New creates a Checker calling probe.
+func New(probe Probe) *Checker {
+	return &Checker{probe: probe}
+}
+
+// Online probes the service, logging when it becomes reachable or unreachable.
+// It returns the *PermanentError of the probe, if any.
+func (c *Checker) Online(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	err := c.probe(ctx)
+	if perr, ok := err.(*PermanentError); ok {
+		return false, perr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	online := err == nil
+	if !c.checked || online != c.online {
+		if online {
+			log.Printf("Online")
+		} else {
+			log.Printf("Offline: %v", err)
+		}
+	}
+	c.online, c.checked = online, true
+	return online, nil
+}
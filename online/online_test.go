@@ -0,0 +1,73 @@
+package online
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// flaky is unreachable for the first failures probes.
+type flaky struct {
+	failures int
+	calls    int
+}
+
+func (f *flaky) probe(ctx context.Context) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func TestChecker(t *testing.T) {
+	ctx := context.Background()
+	f := &flaky{failures: 2}
+	c := New(f.probe)
+	for i, want := range []bool{false, false, true, true} {
+		if got, err := c.Online(ctx); got != want || err != nil {
+			t.Errorf("Online() call %d want (%v, nil), got (%v, %v)", i+1, want, got, err)
+		}
+	}
+
+	rejected := &PermanentError{errors.New("bad credentials")}
+	c = New(func(ctx context.Context) error { return rejected })
+	if got, err := c.Online(ctx); got || err != rejected {
+		t.Errorf("Online() while rejected want (false, %v), got (%v, %v)", rejected, got, err)
+	}
+}
+
+type lister struct {
+	err error
+}
+
+func (l lister) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, l.err
+}
+
+func TestProbes(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	if err := HTTPProbe(server.Client(), url)(ctx); err != nil {
+		t.Errorf("HTTPProbe(%q) failed: %v", url, err)
+	}
+	server.Close()
+	if err := HTTPProbe(http.DefaultClient, url)(ctx); err == nil {
+		t.Errorf("HTTPProbe(%q) of closed server want error, got nil", url)
+	}
+	unreachable, rejected := errors.New("unreachable"), errors.New("bad credentials")
+	isRejected := func(err error) bool { return err == rejected }
+	if err := StorageProbe(lister{}, "manifest", isRejected)(ctx); err != nil {
+		t.Errorf("StorageProbe() failed: %v", err)
+	}
+	if err := StorageProbe(lister{unreachable}, "manifest", isRejected)(ctx); err != unreachable {
+		t.Errorf("StorageProbe() of unreachable storage want %v, got %v", unreachable, err)
+	}
+	err := StorageProbe(lister{rejected}, "manifest", isRejected)(ctx)
+	if perr, ok := err.(*PermanentError); !ok || perr.Err != rejected {
+		t.Errorf("StorageProbe() of rejecting storage want a *PermanentError, got %v", err)
+	}
+}
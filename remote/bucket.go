@@ -0,0 +1,48 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/andreich/docsync/config"
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/storage"
+)
+
+// Bucket is the storage holding the synced files, set up from the
+// configuration for the commands reading it.
+type Bucket struct {
+	Config *config.Restore
+	// Storage retries the operations failing with transient errors.
+	Storage storage.Storage
+	// Enc decrypts the objects.
+	Enc crypt.Encryption
+}
+
+// Open parses the configuration file, and sets up the storage and the
+// decryption it configures.
+func Open(ctx context.Context, configFile string) (*Bucket, error) {
+	cfg := &config.Restore{}
+	if err := cfg.Parse(configFile); err != nil {
+		return nil, fmt.Errorf("could not parse config from %q: %v", configFile, err)
+	}
+	enc, err := crypt.New(cfg.AESPassphrase, crypt.WithLegacyCBC(cfg.LegacyCBC()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create decryption: %v", err)
+	}
+	s, err := storage.FromConfig(ctx, &cfg.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize storage: %v", err)
+	}
+	return &Bucket{
+		Config:  cfg,
+		Storage: storage.WithRetry(s, storage.DefaultRetryPolicy()),
+		Enc:     enc,
+	}, nil
+}
+
+// Manifest downloads and decrypts the remote manifest.
+func (b *Bucket) Manifest(ctx context.Context) (manifest.Manifest, error) {
+	return LoadManifest(ctx, b.Storage, b.Enc, b.Config.RemoteManifestFile, nil, nil)
+}
@@ -0,0 +1,55 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreich/docsync/manifest"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	if _, err := Open(ctx, configFile); err == nil {
+		t.Errorf("Open() of missing config want error, got nil")
+	}
+	config := fmt.Sprintf(`{
+		"aes_passphrase": "this is a passphrase",
+		"storage_type": "local",
+		"storage_path": %q,
+		"dirs": {"/home/me/docs": "docs"},
+		"remote_manifest_file": "manifest"
+	}`, dir)
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	b, err := Open(ctx, configFile)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if b.Config.RemoteManifestFile != "manifest" {
+		t.Errorf("Open() config want remote manifest %q, got %+v", "manifest", b.Config)
+	}
+	var buf bytes.Buffer
+	if err := manifest.New(nil, nil).Dump(&buf); err != nil {
+		t.Fatalf("Dump() failed: %v", err)
+	}
+	put(t, b.Storage, b.Enc, "manifest", buf.Bytes())
+	m, err := b.Manifest(ctx)
+	if err != nil {
+		t.Fatalf("Manifest() failed: %v", err)
+	}
+	if m.Saved().IsZero() {
+		t.Errorf("Manifest() returned a manifest never saved")
+	}
+}
@@ -0,0 +1,286 @@
+// Package remote provides what the command line tools share for working with
+// the synced files in storage: mapping local directories to remote ones,
+// loading the remote manifest and restoring files.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/storage"
+)
+
+// Dirs maps local directories to remote ones, as config.Sync.Dirs.
+type Dirs map[string]string
+
+// Remote returns the remote name of the local file fn, and whether it is in
+// one of the directories.
+func (d Dirs) Remote(fn string) (string, bool) {
+	src, found := longestPrefix(fn, d, func(src, dst string) string { return src })
+	if !found {
+		return "", false
+	}
+	return d[src] + strings.TrimPrefix(fn, src), true
+}
+
+// Local returns the local name of the remote file name, and whether it is in
+// one of the directories.
+func (d Dirs) Local(name string) (string, bool) {
+	src, found := longestPrefix(name, d, func(src, dst string) string { return dst })
+	if !found {
+		return "", false
+	}
+	return src + strings.TrimPrefix(name, d[src]), true
+}
+
+// Stored returns the name and state of the object holding the committed
+// contents of the file of e, either stored by content or under its path within
+// the directories, the path it was renamed from while pending. It returns false
+// for files never uploaded.
+func (d Dirs) Stored(e manifest.Entry) (manifest.Version, bool) {
+	v := manifest.Version{Name: e.Object, Mod: e.Mod, Hash: e.Hash, Size: e.Size}
+	fn := e.Path
+	if e.Pending {
+		if e.Stored == nil {
+			return manifest.Version{}, false
+		}
+		v = *e.Stored
+		if e.From != "" {
+			fn = e.From
+		}
+	}
+	if v.Name == "" {
+		name, found := d.Remote(fn)
+		if !found {
+			return manifest.Version{}, false
+		}
+		v.Name = name
+	}
+	return v, true
+}
+
+// Blob returns the name of the object under prefix holding contents with the
+// MD5 hash, for files stored by content. The name does not reveal the hash.
+func Blob(enc crypt.Encryption, prefix string, hash [md5.Size]byte) string {
+	return prefix + hex.EncodeToString(enc.HMAC(hash[:]))
+}
+
+// longestPrefix returns the key of d for which key returns the longest prefix
+// of s.
+func longestPrefix(s string, d Dirs, key func(src, dst string) string) (string, bool) {
+	var res string
+	longest := -1
+	for src, dst := range d {
+		if p := key(src, dst); strings.HasPrefix(s, p) && len(p) > longest {
+			res, longest = src, len(p)
+		}
+	}
+	return res, longest >= 0
+}
+
+// Object is a file in storage, with what the manifest records about it.
+type Object struct {
+	Name string
+	// Entry is nil for files not in the manifest, like the manifest itself
+	// or deleted files moved to trash.
+	Entry *manifest.Entry
+}
+
+// Join returns the objects with the given names, and their entries in the
+// manifest of the local files synced to dirs. Objects holding the contents of
+// several files stored by content get the first of them by path.
+func Join(names []string, entries []manifest.Entry, dirs Dirs) []Object {
+	byName := make(map[string]*manifest.Entry)
+	for i := range entries {
+		name, found := dirs.Remote(entries[i].Path)
+		if v, stored := dirs.Stored(entries[i]); stored {
+			name, found = v.Name, true
+		}
+		if _, dup := byName[name]; found && !dup {
+			byName[name] = &entries[i]
+		}
+	}
+	var res []Object
+	for _, name := range names {
+		res = append(res, Object{Name: name, Entry: byName[name]})
+	}
+	return res
+}
+
+// LoadManifest downloads and decrypts the manifest stored as name.
+func LoadManifest(ctx context.Context, s storage.Storage, enc crypt.Encryption, name string, include, exclude []string) (manifest.Manifest, error) {
+	data, err := s.Download(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err = enc.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	m := manifest.New(include, exclude)
+	if err := m.Load(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// File is a file to restore.
+type File struct {
+	// Name of the file in storage.
+	Name string
+	// Local is where to restore it.
+	Local string
+	// Mod is the modification time to restore.
+	Mod time.Time
+	// Hash is the MD5 of the contents, to skip restoring files already
+	// present.
+	Hash [md5.Size]byte
+	// Overwrite allows replacing a local file with other contents, which
+	// is otherwise left alone.
+	Overwrite bool
+}
+
+// Status of restoring a File.
+type Status int
+
+// Statuses of restoring a File.
+const (
+	Restored Status = iota
+	// Skipped files were already present, with the same contents.
+	Skipped
+	Failed
+	// Differing files were present with other contents, not overwritten.
+	Differing
+)
+
+func (s Status) String() string {
+	switch s {
+	case Restored:
+		return "restored"
+	case Skipped:
+		return "skipped"
+	case Failed:
+		return "failed"
+	case Differing:
+		return "differing"
+	}
+	return "unknown"
+}
+
+// Restore restores files with parallel downloads, calling done for each file,
+// from one goroutine at a time.
+func Restore(ctx context.Context, s storage.Storage, enc crypt.Encryption, files []File, parallel int, done func(File, Status, error)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	todo := make(chan File)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range todo {
+				status, err := restore(ctx, s, enc, f)
+				mu.Lock()
+				done(f, status, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		todo <- f
+	}
+	close(todo)
+	wg.Wait()
+}
+
+func restore(ctx context.Context, s storage.Storage, enc crypt.Encryption, f File) (Status, error) {
+	if exists, same, err := hasHash(f.Local, f.Hash); err != nil {
+		return Failed, err
+	} else if same {
+		return Skipped, nil
+	} else if exists && !f.Overwrite {
+		return Differing, nil
+	}
+	if err := download(ctx, s, enc, f.Name, f.Local, &f.Hash); err != nil {
+		return Failed, err
+	}
+	if err := os.Chtimes(f.Local, f.Mod, f.Mod); err != nil {
+		return Failed, err
+	}
+	return Restored, nil
+}
+
+// hasHash reports whether fn exists, and whether its contents have the MD5
+// hash.
+func hasHash(fn string, hash [md5.Size]byte) (exists, same bool, err error) {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return true, false, err
+	}
+	return true, bytes.Equal(h.Sum(nil), hash[:]), nil
+}
+
+// Download decrypts the file stored as name to dst, creating the missing
+// directories. dst is replaced only once the download is complete.
+func Download(ctx context.Context, s storage.Storage, enc crypt.Encryption, name, dst string) error {
+	return download(ctx, s, enc, name, dst, nil)
+}
+
+// download is Download, failing without replacing dst if hash is set and the
+// contents do not have it.
+func download(ctx context.Context, s storage.Storage, enc crypt.Encryption, name, dst string, hash *[md5.Size]byte) error {
+	rc, _, err := s.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	r, err := enc.Decrypter(rc)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if sum := h.Sum(nil); err == nil && hash != nil && !bytes.Equal(sum, hash[:]) {
+		err = fmt.Errorf("contents of %s have MD5 %x, want %x", name, sum, *hash)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,269 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+func TestDirs(t *testing.T) {
+	d := Dirs{
+		"/home/me/docs":       "docs",
+		"/home/me/docs/taxes": "taxes",
+		"/home/me/photos/":    "media/photos/",
+	}
+	for _, test := range []struct {
+		local, remote string
+		found         bool
+	}{
+		{"/home/me/docs/a.pdf", "docs/a.pdf", true},
+		{"/home/me/docs/sub/b.pdf", "docs/sub/b.pdf", true},
+		{"/home/me/docs/taxes/2020.pdf", "taxes/2020.pdf", true},
+		{"/home/me/photos/c.jpg", "media/photos/c.jpg", true},
+		{"/home/me/other/d.txt", "", false},
+	} {
+		if got, found := d.Remote(test.local); got != test.remote || found != test.found {
+			t.Errorf("Remote(%q) want (%q, %v), got (%q, %v)", test.local, test.remote, test.found, got, found)
+		}
+		if !test.found {
+			continue
+		}
+		if got, found := d.Local(test.remote); got != test.local || !found {
+			t.Errorf("Local(%q) want (%q, true), got (%q, %v)", test.remote, test.local, got, found)
+		}
+	}
+	if got, found := d.Local("trash/docs/a.pdf"); found {
+		t.Errorf("Local(trash/docs/a.pdf) want not found, got %q", got)
+	}
+}
+
+func TestStored(t *testing.T) {
+	d := Dirs{"/home/me/docs": "docs"}
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	old := manifest.Version{Mod: mod, Hash: md5.Sum([]byte("old")), Size: 3}
+	oldBlob := old
+	oldBlob.Name = "blobs/old"
+	for _, test := range []struct {
+		desc  string
+		e     manifest.Entry
+		want  manifest.Version
+		found bool
+	}{
+		{
+			desc:  "by path",
+			e:     manifest.Entry{Path: "/home/me/docs/a.pdf", Mod: mod, Size: 1},
+			want:  manifest.Version{Name: "docs/a.pdf", Mod: mod, Size: 1},
+			found: true,
+		},
+		{
+			desc:  "by content",
+			e:     manifest.Entry{Path: "/home/me/docs/a.pdf", Mod: mod, Size: 1, Object: "blobs/new"},
+			want:  manifest.Version{Name: "blobs/new", Mod: mod, Size: 1},
+			found: true,
+		},
+		{
+			desc:  "pending by path",
+			e:     manifest.Entry{Path: "/home/me/docs/a.pdf", Pending: true, Stored: &old},
+			want:  manifest.Version{Name: "docs/a.pdf", Mod: mod, Hash: old.Hash, Size: 3},
+			found: true,
+		},
+		{
+			desc:  "pending by content",
+			e:     manifest.Entry{Path: "/home/me/docs/a.pdf", Pending: true, Stored: &oldBlob},
+			want:  oldBlob,
+			found: true,
+		},
+		{
+			desc:  "renamed by path",
+			e:     manifest.Entry{Path: "/home/me/docs/b.pdf", Pending: true, Stored: &old, From: "/home/me/docs/a.pdf"},
+			want:  manifest.Version{Name: "docs/a.pdf", Mod: mod, Hash: old.Hash, Size: 3},
+			found: true,
+		},
+		{
+			desc: "never uploaded",
+			e:    manifest.Entry{Path: "/home/me/docs/a.pdf", Pending: true},
+		},
+		{
+			desc: "outside the dirs",
+			e:    manifest.Entry{Path: "/home/me/other/a.pdf"},
+		},
+	} {
+		if got, found := d.Stored(test.e); got != test.want || found != test.found {
+			t.Errorf("%s: Stored() want (%+v, %v), got (%+v, %v)", test.desc, test.want, test.found, got, found)
+		}
+	}
+}
+
+func TestBlob(t *testing.T) {
+	enc := newEncryption(t)
+	a, b := md5.Sum([]byte("a")), md5.Sum([]byte("b"))
+	if Blob(enc, "blobs/", a) != Blob(enc, "blobs/", a) || Blob(enc, "blobs/", a) == Blob(enc, "blobs/", b) {
+		t.Errorf("Blob() want the same names only for the same hashes")
+	}
+	if got := Blob(enc, "blobs/", a); !strings.HasPrefix(got, "blobs/") || strings.Contains(got, fmt.Sprintf("%x", a)) {
+		t.Errorf("Blob() want a name under blobs/ not revealing the hash, got %q", got)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	entries := []manifest.Entry{
+		{Path: "/home/me/docs/a.pdf", Size: 1},
+		{Path: "/home/me/docs/b.pdf", Size: 2},
+	}
+	got := Join([]string{"docs/a.pdf", "docs/c.pdf", "manifest"}, entries, Dirs{"/home/me/docs": "docs"})
+	want := []Object{
+		{Name: "docs/a.pdf", Entry: &entries[0]},
+		{Name: "docs/c.pdf"},
+		{Name: "manifest"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Join() want %+v, got %+v", want, got)
+	}
+}
+
+func newEncryption(t *testing.T) crypt.Encryption {
+	enc, err := crypt.New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("crypt.New() failed: %v", err)
+	}
+	return enc
+}
+
+func put(t *testing.T, s storage.Storage, enc crypt.Encryption, name string, data []byte) {
+	data, err := enc.Encrypt(data)
+	if err != nil {
+		t.Fatalf("Encrypt() failed: %v", err)
+	}
+	if err := s.Upload(context.Background(), name, data); err != nil {
+		t.Fatalf("Upload(%q) failed: %v", name, err)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemory()
+	enc := newEncryption(t)
+	if _, err := LoadManifest(ctx, s, enc, "manifest", nil, nil); !storage.IsNotExist(err) {
+		t.Errorf("LoadManifest() of missing manifest want %v, got %v", storage.ErrNotExist, err)
+	}
+	var buf bytes.Buffer
+	if err := manifest.New([]string{"include"}, nil).Dump(&buf); err != nil {
+		t.Fatalf("Dump() failed: %v", err)
+	}
+	put(t, s, enc, "manifest", buf.Bytes())
+	m, err := LoadManifest(ctx, s, enc, "manifest", nil, nil)
+	if err != nil {
+		t.Fatalf("LoadManifest() failed: %v", err)
+	}
+	if m.Saved().IsZero() {
+		t.Errorf("LoadManifest() returned a manifest never saved")
+	}
+	put(t, s, enc, "corrupt", []byte("not a manifest"))
+	if _, err := LoadManifest(ctx, s, enc, "corrupt", nil, nil); err == nil {
+		t.Errorf("LoadManifest() of corrupt manifest want error, got nil")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemory()
+	enc := newEncryption(t)
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	contents := map[string][]byte{
+		"a":     []byte("file a"),
+		"sub/b": []byte("file b"),
+		"sub/c": []byte("file c"),
+	}
+	var files []File
+	for name, data := range contents {
+		put(t, s, enc, "docs/"+name, data)
+		files = append(files, File{
+			Name:  "docs/" + name,
+			Local: filepath.Join(dir, filepath.FromSlash(name)),
+			Mod:   mod,
+			Hash:  md5.Sum(data),
+		})
+	}
+	files = append(files, File{Name: "docs/missing", Local: filepath.Join(dir, "missing")})
+	// Contents not matching the manifest are not restored.
+	put(t, s, enc, "docs/wrong", []byte("other contents"))
+	files = append(files, File{Name: "docs/wrong", Local: filepath.Join(dir, "wrong"), Hash: md5.Sum([]byte("contents"))})
+
+	restore := func() map[string]Status {
+		got := make(map[string]Status)
+		Restore(ctx, s, enc, files, 2, func(f File, status Status, err error) {
+			if (status == Failed) != (err != nil) {
+				t.Errorf("restoring %q: status %v with error %v", f.Name, status, err)
+			}
+			got[f.Name] = status
+		})
+		return got
+	}
+	want := map[string]Status{
+		"docs/a":       Restored,
+		"docs/sub/b":   Restored,
+		"docs/sub/c":   Restored,
+		"docs/missing": Failed,
+		"docs/wrong":   Failed,
+	}
+	if got := restore(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restore() want %v, got %v", want, got)
+	}
+	for name, data := range contents {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		got, err := ioutil.ReadFile(fn)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("restored %q want (%q, nil), got (%q, %v)", fn, data, got, err)
+		}
+		if st, err := os.Stat(fn); err != nil || !st.ModTime().Equal(mod) {
+			t.Errorf("restored %q want modification time %v, got %v (error %v)", fn, mod, st.ModTime(), err)
+		}
+	}
+
+	// Files already present are skipped, and changed ones are only
+	// overwritten if allowed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "c"), []byte("changed"), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	want["docs/a"], want["docs/sub/b"], want["docs/sub/c"] = Skipped, Skipped, Differing
+	if got := restore(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restore() again want %v, got %v", want, got)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "c")); string(got) != "changed" {
+		t.Errorf("changed file without Overwrite want %q, got %q", "changed", got)
+	}
+	for i := range files {
+		files[i].Overwrite = true
+	}
+	want["docs/sub/c"] = Restored
+	if got := restore(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restore() with Overwrite want %v, got %v", want, got)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "c")); !bytes.Equal(got, contents["sub/c"]) {
+		t.Errorf("restored changed file want %q, got %q", contents["sub/c"], got)
+	}
+	for _, fn := range []string{"missing", "wrong"} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); !os.IsNotExist(err) {
+			t.Errorf("failed restore left %q: %v", fn, err)
+		}
+	}
+}
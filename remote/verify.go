@@ -0,0 +1,222 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/storage"
+)
+
+// Problem found by Verify.
+type Problem int
+
+// Problems found by Verify.
+const (
+	// Missing files are in the manifest, but not in storage.
+	Missing Problem = iota
+	// Orphaned files are in storage within the synced directories, or with
+	// the prefix of files stored by content, but not in the manifest.
+	Orphaned
+	// Corrupted files do not decrypt, or not to what the manifest recorded.
+	Corrupted
+	// Stale files changed locally since the manifest recorded them, see
+	// VerifyOptions.Local.
+	Stale
+	// Unchecked files could not be downloaded to check them.
+	Unchecked
+	// Pending files changed and are not uploaded yet, which is expected
+	// while syncing rather than a problem with the storage.
+	Pending
+)
+
+func (p Problem) String() string {
+	switch p {
+	case Missing:
+		return "missing"
+	case Orphaned:
+		return "orphaned"
+	case Corrupted:
+		return "corrupted"
+	case Stale:
+		return "stale"
+	case Unchecked:
+		return "unchecked"
+	case Pending:
+		return "pending"
+	}
+	return "unknown"
+}
+
+// Finding is a problem with a file.
+type Finding struct {
+	// Name of the file in storage.
+	Name string
+	// Path of the local file, empty for orphaned files.
+	Path    string
+	Problem Problem
+	// Err tells what is wrong with the file.
+	Err error
+}
+
+// VerifyOptions tells what Verify checks besides comparing the manifest with
+// the listing of the storage.
+type VerifyOptions struct {
+	// Sample is the fraction of the files to download and compare to the
+	// manifest, from 0 for none to 1 for all.
+	Sample float64
+	// Local compares the manifest with the local files, finding those
+	// changed or removed since they were uploaded.
+	Local bool
+	// Parallel is how many files to download at once.
+	Parallel int
+	// Blobs is the prefix of the objects holding the contents of files
+	// stored by content, which are orphaned when not in the manifest.
+	Blobs string
+	// Ignored are the prefixes of the objects not holding synced files,
+	// like the trash, versions and snapshots, which are never orphaned.
+	Ignored []string
+	// Pinned are the objects snapshots refer to, which are not orphaned.
+	Pinned map[string]bool
+}
+
+// Verify compares the manifest entries of the files synced to dirs with the
+// names listed in storage, calling found for each problem, from one goroutine
+// at a time. It returns how many files it downloaded to check.
+func Verify(ctx context.Context, s storage.Storage, enc crypt.Encryption, names []string, entries []manifest.Entry, dirs Dirs, opts *VerifyOptions, found func(Finding)) int {
+	stored := make(map[string]bool)
+	for _, name := range names {
+		stored[name] = true
+	}
+	referenced := make(map[string]bool)
+	var todo []File
+	for _, e := range entries {
+		for _, v := range e.Versions {
+			referenced[v.Name] = true
+		}
+		name, ok := dirs.Remote(e.Path)
+		if !ok {
+			continue
+		}
+		v, uploaded := dirs.Stored(e)
+		if uploaded {
+			name = v.Name
+		}
+		referenced[name] = true
+		if e.Pending {
+			found(Finding{Name: name, Path: e.Path, Problem: Pending, Err: fmt.Errorf("not uploaded since it last changed")})
+			// The contents uploaded before are still checked.
+			if !uploaded {
+				continue
+			}
+		}
+		if !stored[name] {
+			found(Finding{Name: name, Path: e.Path, Problem: Missing, Err: storage.ErrNotExist})
+			continue
+		}
+		if opts.Local && !e.Pending {
+			if err := changed(e); err != nil {
+				found(Finding{Name: name, Path: e.Path, Problem: Stale, Err: err})
+				continue
+			}
+		}
+		if opts.Sample > 0 && rand.Float64() < opts.Sample {
+			todo = append(todo, File{Name: name, Local: e.Path, Mod: v.Mod, Hash: v.Hash})
+		}
+	}
+	for _, name := range names {
+		if referenced[name] || opts.Pinned[name] || hasAnyPrefix(name, opts.Ignored) {
+			continue
+		}
+		if _, ok := dirs.Local(name); ok || (opts.Blobs != "" && strings.HasPrefix(name, opts.Blobs)) {
+			found(Finding{Name: name, Problem: Orphaned, Err: fmt.Errorf("not in the manifest")})
+		}
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	files := make(chan File)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if fd := check(ctx, s, enc, f); fd != nil {
+					mu.Lock()
+					found(*fd)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, f := range todo {
+		files <- f
+	}
+	close(files)
+	wg.Wait()
+	return len(todo)
+}
+
+// hasAnyPrefix reports whether name starts with any of the non-empty prefixes.
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// changed returns an error if the local file of e was changed or removed
+// since recorded in the manifest.
+func changed(e manifest.Entry) error {
+	st, err := os.Stat(e.Path)
+	if err != nil {
+		return err
+	}
+	if !st.ModTime().Equal(e.Mod) {
+		return fmt.Errorf("modified at %v, recorded at %v", st.ModTime(), e.Mod)
+	}
+	return nil
+}
+
+// check downloads and decrypts f, returning a Finding if its contents do not
+// match f.Hash.
+func check(ctx context.Context, s storage.Storage, enc crypt.Encryption, f File) *Finding {
+	rc, _, err := s.Get(ctx, f.Name)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return &Finding{Name: f.Name, Path: f.Local, Problem: Missing, Err: err}
+		}
+		return &Finding{Name: f.Name, Path: f.Local, Problem: Unchecked, Err: err}
+	}
+	defer rc.Close()
+	r, err := enc.Decrypter(rc)
+	if err != nil {
+		return &Finding{Name: f.Name, Path: f.Local, Problem: Corrupted, Err: err}
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		// Errors reading from storage are not for corrupted files.
+		if storage.Classify(err) == storage.Retryable {
+			return &Finding{Name: f.Name, Path: f.Local, Problem: Unchecked, Err: err}
+		}
+		return &Finding{Name: f.Name, Path: f.Local, Problem: Corrupted, Err: err}
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, f.Hash[:]) {
+		return &Finding{Name: f.Name, Path: f.Local, Problem: Corrupted, Err: fmt.Errorf("MD5 %x, recorded %x", sum, f.Hash)}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package remote
+
+import (
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemory()
+	enc := newEncryption(t)
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var entries []manifest.Entry
+	add := func(name, data string, pending bool) {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile() failed: %v", err)
+		}
+		if err := os.Chtimes(fn, mod, mod); err != nil {
+			t.Fatalf("Chtimes() failed: %v", err)
+		}
+		entries = append(entries, manifest.Entry{Path: fn, Mod: mod, Hash: md5.Sum([]byte(data)), Pending: pending})
+	}
+	add("ok", "contents", false)
+	put(t, s, enc, "docs/ok", []byte("contents"))
+	add("corrupted", "contents", false)
+	put(t, s, enc, "docs/corrupted", []byte("other contents"))
+	add("garbage", "contents", false)
+	if err := s.Upload(ctx, "docs/garbage", []byte("not encrypted")); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	add("missing", "contents", false)
+	add("pending", "contents", true)
+	put(t, s, enc, "docs/pending", []byte("old contents"))
+	// Pending, with the contents uploaded before checked.
+	add("stored", "contents", true)
+	entries[len(entries)-1].Stored = &manifest.Version{Mod: mod, Hash: md5.Sum([]byte("old contents"))}
+	put(t, s, enc, "docs/stored", []byte("corrupted contents"))
+	add("renamed", "contents", true)
+	entries[len(entries)-1].Stored = &manifest.Version{Mod: mod, Hash: md5.Sum([]byte("contents"))}
+	entries[len(entries)-1].From = filepath.Join(dir, "gone")
+	add("modified", "contents", false)
+	put(t, s, enc, "docs/modified", []byte("contents"))
+	if err := os.Chtimes(filepath.Join(dir, "modified"), time.Now(), time.Now()); err != nil {
+		t.Fatalf("Chtimes() failed: %v", err)
+	}
+	add("removed", "contents", false)
+	put(t, s, enc, "docs/removed", []byte("contents"))
+	if err := os.Remove(filepath.Join(dir, "removed")); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	// Stored by content, with a version.
+	add("blob", "contents", false)
+	entries[len(entries)-1].Object = "blobs/1"
+	entries[len(entries)-1].Versions = []manifest.Version{{Name: "blobs/0"}}
+	put(t, s, enc, "blobs/1", []byte("contents"))
+	put(t, s, enc, "blobs/0", []byte("old contents"))
+	put(t, s, enc, "blobs/orphaned", []byte("contents"))
+	entries = append(entries, manifest.Entry{Path: "/elsewhere/file"})
+	put(t, s, enc, "docs/orphaned", []byte("contents"))
+	put(t, s, enc, "manifest", []byte("not within the dirs"))
+	put(t, s, enc, "docs/trash/removed", []byte("contents"))
+	put(t, s, enc, "blobs/pinned", []byte("contents"))
+
+	names, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	dirs := Dirs{dir: "docs"}
+	for _, test := range []struct {
+		desc    string
+		opts    VerifyOptions
+		checked int
+		want    map[string][]Problem
+	}{
+		{
+			desc: "listing only",
+			want: map[string][]Problem{
+				"docs/missing":       {Missing},
+				"docs/pending":       {Pending},
+				"docs/stored":        {Pending},
+				"docs/gone":          {Pending, Missing},
+				"docs/orphaned":      {Orphaned},
+				"docs/trash/removed": {Orphaned},
+			},
+		},
+		{
+			desc: "everything",
+			opts: VerifyOptions{
+				Sample:   1,
+				Local:    true,
+				Parallel: 2,
+				Blobs:    "blobs/",
+				Ignored:  []string{"docs/trash/", ""},
+				Pinned:   map[string]bool{"blobs/pinned": true},
+			},
+			checked: 5,
+			want: map[string][]Problem{
+				"docs/missing":   {Missing},
+				"docs/pending":   {Pending},
+				"docs/stored":    {Pending, Corrupted},
+				"docs/gone":      {Pending, Missing},
+				"docs/modified":  {Stale},
+				"docs/removed":   {Stale},
+				"docs/orphaned":  {Orphaned},
+				"docs/corrupted": {Corrupted},
+				"docs/garbage":   {Corrupted},
+				"blobs/orphaned": {Orphaned},
+			},
+		},
+	} {
+		got := make(map[string][]Problem)
+		checked := Verify(ctx, s, enc, names, entries, dirs, &test.opts, func(f Finding) {
+			if f.Err == nil {
+				t.Errorf("%s: %v finding for %q without error", test.desc, f.Problem, f.Name)
+			}
+			got[f.Name] = append(got[f.Name], f.Problem)
+		})
+		if checked != test.checked {
+			t.Errorf("%s: Verify() want %d files checked, got %d", test.desc, test.checked, checked)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Verify() want %v, got %v", test.desc, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+// Package signals handles the signals the long running commands respond to.
+package signals
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Handle returns a context cancelled by SIGINT or SIGTERM, and a channel
+// receiving SIGUSR1. A second SIGINT or SIGTERM kills the process.
+func Handle() (context.Context, <-chan os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		signal.Stop(stop)
+		log.Printf("Received %v, shutting down", sig)
+		cancel()
+	}()
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	return ctx, usr1
+}
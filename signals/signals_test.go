@@ -0,0 +1,35 @@
+package signals
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandle(t *testing.T) {
+	ctx, usr1 := Handle()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Kill(SIGUSR1) failed: %v", err)
+	}
+	select {
+	case sig := <-usr1:
+		if sig != syscall.SIGUSR1 {
+			t.Errorf("received %v, want %v", sig, syscall.SIGUSR1)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("SIGUSR1 not received")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("context cancelled by SIGUSR1")
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill(SIGTERM) failed: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("context not cancelled by SIGTERM")
+	}
+}
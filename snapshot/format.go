@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Snapshots are encoded, before being encrypted, as JSON lines: a header,
+// followed by a line for each file sorted by path. Times are in RFC 3339
+// format, in UTC, and hashes are the hex encoded MD5 of the contents. For
+// example:
+//
+//	{"docsync_snapshot":1,"time":"2021-03-01T12:00:00Z"}
+//	{"path":"/home/me/docs/a.pdf","name":"docs/a.pdf","mod":"2021-03-01T11:00:00Z","hash":"...","size":1024}
+//	{"path":"/home/me/docs/b.pdf","name":"blobs/...","mod":"2021-03-01T11:00:00Z","hash":"...","size":1024,"blob":true}
+//
+// Fields are only added within a version, and left out when empty.
+
+// FormatVersion is the version of the format written by Write. Snapshots in
+// newer versions are not read, as they may record more than understood.
+const FormatVersion = 1
+
+// header is the first line of an encoded snapshot.
+type header struct {
+	Version int       `json:"docsync_snapshot"`
+	Time    time.Time `json:"time"`
+}
+
+// record is the line of a file in an encoded snapshot, see File.
+type record struct {
+	Path string    `json:"path"`
+	Name string    `json:"name"`
+	Mod  time.Time `json:"mod"`
+	Hash string    `json:"hash"`
+	Size int64     `json:"size"`
+	Blob bool      `json:"blob,omitempty"`
+}
+
+func encode(w io.Writer, snap *Snapshot) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(header{Version: FormatVersion, Time: snap.Time.UTC()}); err != nil {
+		return err
+	}
+	for _, f := range snap.Files {
+		r := record{
+			Path: f.Path,
+			Name: f.Name,
+			Mod:  f.Mod.UTC(),
+			Hash: hex.EncodeToString(f.Hash[:]),
+			Size: f.Size,
+			Blob: f.Blob,
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func decode(data []byte) (*Snapshot, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	h := &header{}
+	if err := dec.Decode(h); err != nil {
+		return nil, fmt.Errorf("not a snapshot: %v", err)
+	}
+	switch {
+	case h.Version <= 0:
+		return nil, fmt.Errorf("not a snapshot: no format version")
+	case h.Version > FormatVersion:
+		return nil, fmt.Errorf("snapshot format version %d is newer than %d", h.Version, FormatVersion)
+	}
+	snap := &Snapshot{Time: h.Time}
+	for {
+		r := record{}
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		f := File{Path: r.Path, Name: r.Name, Mod: r.Mod, Size: r.Size, Blob: r.Blob}
+		h, err := hex.DecodeString(r.Hash)
+		if err != nil || len(h) != md5.Size || r.Path == "" || r.Name == "" {
+			return nil, fmt.Errorf("invalid file %q in snapshot", r.Path)
+		}
+		copy(f.Hash[:], h)
+		snap.Files = append(snap.Files, f)
+	}
+	return snap, nil
+}
@@ -0,0 +1,215 @@
+// Package snapshot records what the synced files looked like at a point in
+// time, as immutable encrypted records in storage.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/versions"
+)
+
+// timeFormat sorts like the times, as long as they are in UTC.
+const timeFormat = "2006-01-02T15:04:05Z"
+
+// File is a synced file in a snapshot.
+type File struct {
+	// Path of the local file.
+	Path string
+	// Name of the remote copy of the file when the snapshot was taken.
+	Name string
+	Mod  time.Time
+	Hash [md5.Size]byte
+	Size int64
+	// Blob is set for files stored by content, named after their blob.
+	Blob bool
+}
+
+// Snapshot is the state of the synced files at a point in time.
+type Snapshot struct {
+	Time time.Time
+	// Files sorted by path.
+	Files []File
+}
+
+// New returns a snapshot at t of the files in the manifest entries which are in
+// storage, synced to dirs. Pending files are recorded as they are in storage,
+// if they were uploaded before. Files stored by content refer to their blobs.
+func New(t time.Time, entries []manifest.Entry, dirs remote.Dirs) *Snapshot {
+	snap := &Snapshot{Time: t.UTC().Truncate(time.Second)}
+	for _, e := range entries {
+		v, found := dirs.Stored(e)
+		if !found {
+			continue
+		}
+		blob := e.Object != ""
+		if e.Pending {
+			blob = e.Stored.Name != ""
+		}
+		snap.Files = append(snap.Files, File{Path: e.Path, Name: v.Name, Mod: v.Mod, Hash: v.Hash, Size: v.Size, Blob: blob})
+	}
+	sort.Slice(snap.Files, func(a, b int) bool { return snap.Files[a].Path < snap.Files[b].Path })
+	return snap
+}
+
+// Name returns the remote name of the snapshot taken at t.
+func Name(prefix string, t time.Time) string {
+	return prefix + t.UTC().Format(timeFormat)
+}
+
+// Write encrypts and uploads snap under prefix. Snapshots are not overwritten:
+// writing one taken at the same time as an existing one fails.
+func Write(ctx context.Context, s storage.Storage, enc crypt.Encryption, prefix string, snap *Snapshot) error {
+	name := Name(prefix, snap.Time)
+	if _, err := s.Stat(ctx, name); err == nil {
+		return &ExistsError{Name: name}
+	} else if !storage.IsNotExist(err) {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, snap); err != nil {
+		return err
+	}
+	data, err := enc.Encrypt(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return s.Upload(ctx, name, data)
+}
+
+// ExistsError is returned when writing a snapshot which already exists.
+type ExistsError struct {
+	Name string
+}
+
+func (e *ExistsError) Error() string {
+	return "snapshot " + e.Name + " already exists"
+}
+
+// List returns the times of the snapshots under prefix, oldest first.
+func List(ctx context.Context, s storage.Storage, prefix string) ([]time.Time, error) {
+	names, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var res []time.Time
+	for _, name := range names {
+		t, err := time.Parse(timeFormat, strings.TrimPrefix(name, prefix))
+		if err != nil {
+			// Not a snapshot.
+			continue
+		}
+		res = append(res, t)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Before(res[b]) })
+	return res, nil
+}
+
+// Find returns the newest of times, sorted oldest first, at or before t.
+func Find(times []time.Time, t time.Time) (time.Time, bool) {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(t) })
+	if i == 0 {
+		return time.Time{}, false
+	}
+	return times[i-1], true
+}
+
+// Read downloads and decrypts the snapshot under prefix taken at t.
+func Read(ctx context.Context, s storage.Storage, enc crypt.Encryption, prefix string, t time.Time) (*Snapshot, error) {
+	data, err := s.Download(ctx, Name(prefix, t))
+	if err != nil {
+		return nil, err
+	}
+	data, err = enc.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// Diff returns the changes to the files from the snapshot from to the snapshot
+// to, sorted by path. Files with the same contents are unchanged, and new files
+// with the same contents as a removed file are renamed from it.
+func Diff(from, to *Snapshot) []manifest.Change {
+	before := make(map[string]File)
+	for _, f := range from.Files {
+		before[f.Path] = f
+	}
+	var res []manifest.Change
+	var added []File
+	for _, f := range to.Files {
+		old, found := before[f.Path]
+		switch {
+		case !found:
+			added = append(added, f)
+		case old.Hash != f.Hash:
+			res = append(res, manifest.Change{Path: f.Path, Kind: manifest.Modified})
+		}
+	}
+	for _, f := range to.Files {
+		delete(before, f.Path)
+	}
+	for _, f := range added {
+		c := manifest.Change{Path: f.Path, Kind: manifest.Added}
+		// Files are sorted by path, renames are from the first match.
+		for _, old := range from.Files {
+			if _, removed := before[old.Path]; removed && old.Hash == f.Hash && old.Size == f.Size {
+				delete(before, old.Path)
+				c = manifest.Change{Path: f.Path, Kind: manifest.Renamed, From: old.Path}
+				break
+			}
+		}
+		res = append(res, c)
+	}
+	for path := range before {
+		res = append(res, manifest.Change{Path: path, Kind: manifest.Removed})
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Path < res[b].Path })
+	return res
+}
+
+// Pinned returns the name of the object to keep for f to be restored: its blob
+// if stored by content, or else the version named after its remote copy and
+// modification time. Remote copies referred to by snapshots are copied there
+// before being overwritten or deleted.
+func Pinned(f File, versionsPrefix string) string {
+	if f.Blob {
+		return f.Name
+	}
+	return versions.Name(versionsPrefix, f.Name, f.Mod)
+}
+
+// Locate returns the name of the object holding the contents of f now, given
+// the current manifest: the remote copy if unchanged since the snapshot, a
+// version kept of it, or else the object pinned for the snapshot.
+func Locate(f File, m manifest.Manifest, versionsPrefix string) string {
+	e, found := m.Lookup(f.Path)
+	if f.Blob || !found {
+		return Pinned(f, versionsPrefix)
+	}
+	stored := e.Hash
+	if e.Pending {
+		if e.Stored == nil {
+			stored = [md5.Size]byte{}
+		} else {
+			stored = e.Stored.Hash
+		}
+	}
+	if stored == f.Hash {
+		return f.Name
+	}
+	for i := len(e.Versions) - 1; i >= 0; i-- {
+		if e.Versions[i].Hash == f.Hash {
+			return e.Versions[i].Name
+		}
+	}
+	return Pinned(f, versionsPrefix)
+}
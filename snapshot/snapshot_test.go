@@ -0,0 +1,201 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/crypt"
+	"github.com/andreich/docsync/manifest"
+	"github.com/andreich/docsync/remote"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+var (
+	mod  = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	dirs = remote.Dirs{"/home/me/docs": "docs"}
+)
+
+func TestNew(t *testing.T) {
+	entries := []manifest.Entry{
+		{Path: "/home/me/docs/b.pdf", Mod: mod, Hash: md5.Sum([]byte("b")), Size: 1},
+		{Path: "/home/me/docs/a.pdf", Mod: mod, Hash: md5.Sum([]byte("a")), Size: 1},
+		{Path: "/home/me/docs/blob.pdf", Mod: mod, Hash: md5.Sum([]byte("a")), Size: 1, Object: "blobs/a"},
+		{Path: "/home/me/docs/added.pdf", Mod: mod, Pending: true},
+		{Path: "/home/me/docs/modified.pdf", Mod: mod.Add(time.Hour), Pending: true, Stored: &manifest.Version{Mod: mod, Hash: md5.Sum([]byte("m")), Size: 1}},
+		{Path: "/home/me/other/c.pdf", Mod: mod},
+	}
+	got := New(mod.Add(1500*time.Millisecond), entries, dirs)
+	want := &Snapshot{
+		Time: mod.Add(time.Second),
+		Files: []File{
+			{Path: "/home/me/docs/a.pdf", Name: "docs/a.pdf", Mod: mod, Hash: md5.Sum([]byte("a")), Size: 1},
+			{Path: "/home/me/docs/b.pdf", Name: "docs/b.pdf", Mod: mod, Hash: md5.Sum([]byte("b")), Size: 1},
+			{Path: "/home/me/docs/blob.pdf", Name: "blobs/a", Mod: mod, Hash: md5.Sum([]byte("a")), Size: 1, Blob: true},
+			{Path: "/home/me/docs/modified.pdf", Name: "docs/modified.pdf", Mod: mod, Hash: md5.Sum([]byte("m")), Size: 1},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("New() want %+v, got %+v", want, got)
+	}
+}
+
+func TestWriteListRead(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemory()
+	enc, err := crypt.New("this is a passphrase")
+	if err != nil {
+		t.Fatalf("crypt.New() failed: %v", err)
+	}
+	if err := s.Upload(ctx, "snapshots/not a snapshot", []byte("data")); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	var snaps []*Snapshot
+	for _, tm := range []time.Time{mod.Add(time.Hour), mod} {
+		snap := &Snapshot{
+			Time: tm,
+			Files: []File{
+				{Path: "/home/me/docs/a.pdf", Name: "docs/a.pdf", Mod: mod, Hash: md5.Sum([]byte(tm.String())), Size: 1},
+				{Path: "/home/me/docs/b.pdf", Name: "blobs/b", Mod: mod, Hash: md5.Sum([]byte("b")), Size: 1, Blob: true},
+			},
+		}
+		if err := Write(ctx, s, enc, "snapshots/", snap); err != nil {
+			t.Fatalf("Write(%v) failed: %v", tm, err)
+		}
+		snaps = append(snaps, snap)
+	}
+	if err := Write(ctx, s, enc, "snapshots/", snaps[0]); err == nil {
+		t.Errorf("Write() of existing snapshot want error, got nil")
+	}
+	data, err := s.Download(ctx, "snapshots/2021-03-01T12:00:00Z")
+	if err != nil || bytes.Contains(data, []byte("docs/a.pdf")) {
+		t.Errorf("Download() of snapshot want encrypted data, got (%q, %v)", data, err)
+	}
+
+	times, err := List(ctx, s, "snapshots/")
+	if want := []time.Time{mod, mod.Add(time.Hour)}; err != nil || !reflect.DeepEqual(times, want) {
+		t.Errorf("List() want (%v, nil), got (%v, %v)", want, times, err)
+	}
+	for _, want := range snaps {
+		got, err := Read(ctx, s, enc, "snapshots/", want.Time)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Read(%v) want (%+v, nil), got (%+v, %v)", want.Time, want, got, err)
+		}
+	}
+	if _, err := Read(ctx, s, enc, "snapshots/", mod.Add(time.Minute)); !storage.IsNotExist(err) {
+		t.Errorf("Read() of missing snapshot want %v, got %v", storage.ErrNotExist, err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	times := []time.Time{mod, mod.Add(time.Hour), mod.Add(24 * time.Hour)}
+	for _, test := range []struct {
+		at    time.Time
+		want  time.Time
+		found bool
+	}{
+		{mod.Add(-time.Second), time.Time{}, false},
+		{mod, mod, true},
+		{mod.Add(2 * time.Hour), mod.Add(time.Hour), true},
+		{mod.Add(48 * time.Hour), mod.Add(24 * time.Hour), true},
+	} {
+		if got, found := Find(times, test.at); !got.Equal(test.want) || found != test.found {
+			t.Errorf("Find(%v) want (%v, %v), got (%v, %v)", test.at, test.want, test.found, got, found)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	file := func(path, contents string) File {
+		return File{Path: path, Name: path, Hash: md5.Sum([]byte(contents))}
+	}
+	from := &Snapshot{Files: []File{file("a", "a"), file("b", "b"), file("c", "c"), file("d", "d"), file("f", "f")}}
+	to := &Snapshot{Files: []File{file("a", "a"), file("b", "changed"), file("d", "d"), file("e", "e"), file("g", "f"), file("h", "f")}}
+	want := []manifest.Change{
+		{Path: "b", Kind: manifest.Modified},
+		{Path: "c", Kind: manifest.Removed},
+		{Path: "e", Kind: manifest.Added},
+		{Path: "g", Kind: manifest.Renamed, From: "f"},
+		{Path: "h", Kind: manifest.Added},
+	}
+	if got := Diff(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() want %v, got %v", want, got)
+	}
+}
+
+// fakeManifest returns entries from Lookup.
+type fakeManifest struct {
+	manifest.Manifest
+	entries map[string]manifest.Entry
+}
+
+func (m *fakeManifest) Lookup(path string) (manifest.Entry, bool) {
+	e, found := m.entries[path]
+	return e, found
+}
+
+func TestDecode(t *testing.T) {
+	const file = `{"path":"/home/me/docs/a.pdf","name":"docs/a.pdf","mod":"2021-03-01T12:00:00Z","hash":"0cc175b9c0f1b6a831c399e269772661","size":1}`
+	var buf bytes.Buffer
+	snap := &Snapshot{Time: mod, Files: []File{{Path: "/home/me/docs/a.pdf", Name: "docs/a.pdf", Mod: mod, Hash: md5.Sum([]byte("a")), Size: 1}}}
+	if err := encode(&buf, snap); err != nil {
+		t.Fatalf("encode() failed: %v", err)
+	}
+	if want := `{"docsync_snapshot":1,"time":"2021-03-01T12:00:00Z"}` + "\n" + file + "\n"; buf.String() != want {
+		t.Errorf("encode() want\n%s\ngot\n%s", want, buf.String())
+	}
+	for _, test := range []struct {
+		desc string
+		data string
+	}{
+		{"empty", ""},
+		{"no version", `{"time":"2021-03-01T12:00:00Z"}`},
+		{"newer version", `{"docsync_snapshot":2,"time":"2021-03-01T12:00:00Z"}`},
+		{"invalid hash", `{"docsync_snapshot":1}` + "\n" + strings.Replace(file, "0cc1", "", 1)},
+		{"no name", `{"docsync_snapshot":1}` + "\n" + strings.Replace(file, `"docs/a.pdf"`, `""`, 1)},
+	} {
+		if _, err := decode([]byte(test.data)); err == nil {
+			t.Errorf("decode() of %s want error, got nil", test.desc)
+		}
+	}
+}
+
+func TestLocate(t *testing.T) {
+	hash := func(s string) [md5.Size]byte { return md5.Sum([]byte(s)) }
+	m := &fakeManifest{entries: map[string]manifest.Entry{
+		"/home/me/docs/same.pdf":    {Hash: hash("v1")},
+		"/home/me/docs/pending.pdf": {Hash: hash("v2"), Pending: true, Stored: &manifest.Version{Hash: hash("v1")}},
+		"/home/me/docs/added.pdf":   {Hash: hash("v1"), Pending: true},
+		"/home/me/docs/changed.pdf": {Hash: hash("v3"), Versions: []manifest.Version{
+			{Name: "versions/docs/changed.pdf@1", Hash: hash("v1")},
+			{Name: "versions/docs/changed.pdf@2", Hash: hash("v2")},
+		}},
+		"/home/me/docs/blob.pdf": {Hash: hash("v2"), Object: "blobs/v2"},
+	}}
+	for _, test := range []struct {
+		path string
+		blob bool
+		want string
+	}{
+		{"/home/me/docs/same.pdf", false, "docs/same.pdf"},
+		{"/home/me/docs/pending.pdf", false, "docs/pending.pdf"},
+		{"/home/me/docs/added.pdf", false, "versions/docs/added.pdf@2021-03-01T12:00:00.000000000Z"},
+		{"/home/me/docs/changed.pdf", false, "versions/docs/changed.pdf@1"},
+		{"/home/me/docs/deleted.pdf", false, "versions/docs/deleted.pdf@2021-03-01T12:00:00.000000000Z"},
+		{"/home/me/docs/blob.pdf", true, "blobs/v1"},
+	} {
+		name, _ := dirs.Remote(test.path)
+		if test.blob {
+			name = "blobs/v1"
+		}
+		f := File{Path: test.path, Name: name, Mod: mod, Hash: hash("v1"), Blob: test.blob}
+		if got := Locate(f, m, "versions/"); got != test.want {
+			t.Errorf("Locate(%q) want %q, got %q", test.path, test.want, got)
+		}
+	}
+}
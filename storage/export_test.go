@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+
+	googleStorage "cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// NewWithHTTPClient returns a Google Cloud Storage for bucket sending its
+// requests through hc, bypassing the replayer set up by TestMain.
+func NewWithHTTPClient(ctx context.Context, bucket string, hc *http.Client) (Storage, error) {
+	client, err := googleStorage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		return nil, err
+	}
+	return &storageImpl{
+		client: client,
+		bucket: client.Bucket(bucket),
+	}, nil
+}
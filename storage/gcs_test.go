@@ -0,0 +1,267 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+type fakeGCSObject struct {
+	data     []byte
+	modified time.Time
+}
+
+// fakeGCSResource is the JSON API resource of an object.
+type fakeGCSResource struct {
+	Kind       string `json:"kind"`
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	Size       string `json:"size"`
+	MD5Hash    string `json:"md5Hash"`
+	Updated    string `json:"updated"`
+}
+
+// fakeGCS implements enough of the JSON API of Google Cloud Storage, and of
+// the XML API used for reads, for a single bucket to exercise storageImpl.
+type fakeGCS struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeGCSObject
+}
+
+func (f *fakeGCS) resource(name string, obj fakeGCSObject) fakeGCSResource {
+	sum := md5.Sum(obj.data)
+	return fakeGCSResource{
+		Kind:       "storage#object",
+		Bucket:     f.bucket,
+		Name:       name,
+		Generation: fmt.Sprint(obj.modified.UnixNano()),
+		Size:       fmt.Sprint(len(obj.data)),
+		MD5Hash:    base64.StdEncoding.EncodeToString(sum[:]),
+		Updated:    obj.modified.Format(time.RFC3339Nano),
+	}
+}
+
+func (f *fakeGCS) error(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, msg)
+}
+
+func (f *fakeGCS) json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// segments returns the unescaped path segments of r, in which object names
+// have their slashes escaped.
+func segments(r *http.Request) []string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i, p := range parts {
+		parts[i], _ = url.PathUnescape(p)
+	}
+	return parts
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/"):
+		f.upload(w, r)
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/"):
+		f.api(w, r, segments(r)[3:])
+	default:
+		// XML API reads, with the object name unescaped in the path.
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) != 2 || parts[0] != f.bucket || r.Method != http.MethodGet {
+			f.error(w, http.StatusNotImplemented, "not implemented")
+			return
+		}
+		f.read(w, parts[1])
+	}
+}
+
+func (f *fakeGCS) read(w http.ResponseWriter, name string) {
+	obj, found := f.objects[name]
+	if !found {
+		f.error(w, http.StatusNotFound, "No such object")
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+	w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+	w.Write(obj.data)
+}
+
+// upload handles multipart uploads, which is what the client uses for
+// objects smaller than its chunk size.
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		f.error(w, http.StatusNotImplemented, "only multipart uploads are implemented")
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		f.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var parts [][]byte
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		parts = append(parts, data)
+	}
+	var meta struct {
+		Name string `json:"name"`
+	}
+	if len(parts) != 2 || json.Unmarshal(parts[0], &meta) != nil || meta.Name == "" {
+		f.error(w, http.StatusBadRequest, "want metadata and media parts")
+		return
+	}
+	obj := fakeGCSObject{data: parts[1], modified: time.Now().UTC()}
+	f.objects[meta.Name] = obj
+	f.json(w, f.resource(meta.Name, obj))
+}
+
+// api handles the requests under /storage/v1/b/, given their path segments
+// after it.
+func (f *fakeGCS) api(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) < 2 || parts[0] != f.bucket || parts[1] != "o" {
+		f.error(w, http.StatusNotFound, "No such bucket")
+		return
+	}
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		var items []fakeGCSResource
+		for name, obj := range f.objects {
+			if strings.HasPrefix(name, prefix) {
+				items = append(items, f.resource(name, obj))
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+		f.json(w, map[string]interface{}{"kind": "storage#objects", "items": items})
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		obj, found := f.objects[parts[2]]
+		if !found {
+			f.error(w, http.StatusNotFound, "No such object")
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" {
+			f.read(w, parts[2])
+			return
+		}
+		f.json(w, f.resource(parts[2], obj))
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		if _, found := f.objects[parts[2]]; !found {
+			f.error(w, http.StatusNotFound, "No such object")
+			return
+		}
+		delete(f.objects, parts[2])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 8 && parts[3] == "rewriteTo" && r.Method == http.MethodPost:
+		obj, found := f.objects[parts[2]]
+		if !found || parts[5] != f.bucket {
+			f.error(w, http.StatusNotFound, "No such object")
+			return
+		}
+		obj.modified = time.Now().UTC()
+		f.objects[parts[7]] = obj
+		size := fmt.Sprint(len(obj.data))
+		f.json(w, map[string]interface{}{
+			"kind":                "storage#rewriteResponse",
+			"totalBytesRewritten": size,
+			"objectSize":          size,
+			"done":                true,
+			"resource":            f.resource(parts[7], obj),
+		})
+	default:
+		f.error(w, http.StatusNotImplemented, "not implemented")
+	}
+}
+
+// redirect sends all the requests of the client to a test server, whichever
+// Google host they are for.
+type redirect struct {
+	host string
+}
+
+func (rd redirect) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := *r
+	u := *r.URL
+	u.Scheme, u.Host = "http", rd.host
+	req.URL = &u
+	return http.DefaultTransport.RoundTrip(&req)
+}
+
+// newFakeGCS starts a fake Google Cloud Storage server and returns a Storage
+// connected to it.
+func newFakeGCS(t *testing.T) (storage.Storage, func()) {
+	fake := &fakeGCS{bucket: "backup", objects: map[string]fakeGCSObject{}}
+	server := httptest.NewServer(fake)
+	client := &http.Client{Transport: redirect{host: strings.TrimPrefix(server.URL, "http://")}}
+	s, err := storage.NewWithHTTPClient(context.Background(), fake.bucket, client)
+	if err != nil {
+		server.Close()
+		t.Fatalf("NewWithHTTPClient() failed: %v", err)
+	}
+	return s, server.Close
+}
+
+// TestGCS runs the conformance suite against a fake server, covering the
+// requests which are not part of the recorded replay.
+func TestGCS(t *testing.T) {
+	s, cleanup := newFakeGCS(t)
+	defer cleanup()
+	storagetest.Conformance(t, s)
+}
+
+// TestGCSConformance runs the conformance suite against a real bucket. It needs
+// -record and the bucket name in DOCSYNC_CONFORMANCE_BUCKET.
+func TestGCSConformance(t *testing.T) {
+	bucket := os.Getenv("DOCSYNC_CONFORMANCE_BUCKET")
+	if f := flag.Lookup("record"); f == nil || f.Value.String() != "true" || bucket == "" {
+		t.Skip("needs -record and DOCSYNC_CONFORMANCE_BUCKET")
+	}
+	ctx := context.Background()
+	creds := []byte(os.Getenv("DOCSYNC_CREDS_JSON"))
+	if len(creds) == 0 {
+		var err error
+		if creds, err = ioutil.ReadFile("creds.json"); err != nil {
+			t.Fatalf("could not load credentials: %v", err)
+		}
+	}
+	s, err := storage.New(ctx, bucket, creds)
+	if err != nil {
+		t.Fatalf("could not create Storage: %v", err)
+	}
+	storagetest.Conformance(t, s)
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// tempPrefix is the prefix of the files being written by localStorage.Put.
+const tempPrefix = ".docsync-tmp-"
+
+// NewLocal creates a Storage keeping the files under the given directory, for
+// example a NAS mount or an external disk. File names are slash separated
+// paths relative to root; as on a file system, a name cannot be both a file
+// and the prefix of another file followed by a slash.
+func NewLocal(root string) (Storage, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", root)
+	}
+	return &localStorage{
+		root: root,
+	}, nil
+}
+
+type localStorage struct {
+	root string
+}
+
+// path returns the local path for name, refusing names outside root.
+func (l *localStorage) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if name == "" || clean == "/" || clean[1:] != name {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name)), nil
+}
+
+func (l *localStorage) Upload(ctx context.Context, name string, contents []byte) error {
+	return upload(ctx, l, name, contents)
+}
+
+func (l *localStorage) Download(ctx context.Context, name string) ([]byte, error) {
+	return download(ctx, l, name)
+}
+
+// Put writes to a temporary file renamed to name once complete, so readers
+// never see a partial file.
+func (l *localStorage) Put(ctx context.Context, name string, r io.Reader, opts *PutOptions) error {
+	fn, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fn)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (l *localStorage) Get(ctx context.Context, name string) (io.ReadCloser, Attrs, error) {
+	fn, err := l.path(name)
+	if err != nil {
+		return nil, Attrs{}, err
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) || isNotDir(err) {
+		return nil, Attrs{}, ErrNotExist
+	}
+	if err != nil {
+		return nil, Attrs{}, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Attrs{}, err
+	}
+	if st.IsDir() {
+		// Directories only exist as prefixes of other files.
+		f.Close()
+		return nil, Attrs{}, ErrNotExist
+	}
+	return f, Attrs{
+		Name:    name,
+		Size:    st.Size(),
+		Updated: st.ModTime(),
+	}, nil
+}
+
+// Delete also removes the directories left empty, up to root.
+func (l *localStorage) Delete(ctx context.Context, name string) error {
+	fn, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if _, err := l.Stat(ctx, name); err != nil {
+		return err
+	}
+	if err := os.Remove(fn); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(fn); dir != filepath.Clean(l.root); dir = filepath.Dir(dir) {
+		// Fails for directories which are not empty.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat leaves MD5 unset, as computing it would mean reading the whole file.
+func (l *localStorage) Stat(ctx context.Context, name string) (Attrs, error) {
+	r, attrs, err := l.Get(ctx, name)
+	if err != nil {
+		return Attrs{}, err
+	}
+	r.Close()
+	return attrs, nil
+}
+
+func (l *localStorage) Copy(ctx context.Context, src, dst string) error {
+	r, _, err := l.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return l.Put(ctx, dst, r, nil)
+}
+
+// isNotDir reports whether err is due to a file being used as a directory, as
+// when opening "a/b" with "a" being a file.
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+func (l *localStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var res []string
+	err := filepath.Walk(l.root, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, fn)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			res = append(res, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
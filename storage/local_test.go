@@ -0,0 +1,52 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "docsync-local")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err := storage.NewLocal(filepath.Join(root, "missing")); err == nil {
+		t.Errorf("NewLocal() of missing directory want error, got nil")
+	}
+	s, err := storage.NewLocal(root)
+	if err != nil {
+		t.Fatalf("NewLocal() failed: %v", err)
+	}
+	storagetest.Conformance(t, s)
+
+	// Leftovers of interrupted writes are not listed.
+	if err := ioutil.WriteFile(filepath.Join(root, "conformance", ".docsync-tmp-123"), nil, 0600); err != nil {
+		t.Fatalf("could not write temporary file: %v", err)
+	}
+	want := []string{"conformance/empty"}
+	if got, err := s.List(ctx, "conformance/e"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("List(conformance/e) want %v, got (%v, %v)", want, got, err)
+	}
+	if got, err := s.List(ctx, "conformance/.docsync"); err != nil || len(got) != 0 {
+		t.Errorf("List(conformance/.docsync) want nothing, got (%v, %v)", got, err)
+	}
+
+	for _, name := range []string{"", "/abs", "../escape", "dir/../../escape"} {
+		if _, err := s.Download(ctx, name); err == nil {
+			t.Errorf("Download(%q) want error, got nil", name)
+		}
+		if err := s.Upload(ctx, name, nil); err == nil {
+			t.Errorf("Upload(%q) want error, got nil", name)
+		}
+	}
+}
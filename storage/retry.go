@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	googleStorage "cloud.google.com/go/storage"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Class of an error, telling whether the operation failing with it should be
+// retried.
+type Class int
+
+// Classes of errors.
+const (
+	// Permanent errors fail again when retrying.
+	Permanent Class = iota
+	// Retryable errors are transient, like throttling or connection resets.
+	Retryable
+	// NotFound errors are for missing files, see IsNotExist.
+	NotFound
+)
+
+func (c Class) String() string {
+	switch c {
+	case Permanent:
+		return "permanent"
+	case Retryable:
+		return "retryable"
+	case NotFound:
+		return "not found"
+	}
+	return "unknown"
+}
+
+// Classify returns the class of err, which should not be nil.
+func Classify(err error) Class {
+	if IsNotExist(err) {
+		return NotFound
+	}
+	chain := causes(err)
+	// Before timeouts, which they are reported as by some errors.
+	for _, err := range chain {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return Permanent
+		}
+	}
+	for _, err := range chain {
+		if code, ok := statusCode(err); ok {
+			return classifyStatus(code)
+		}
+		switch e := err.(type) {
+		case *net.DNSError:
+			// Looking up the storage fails while offline.
+			return Retryable
+		case net.Error:
+			if e.Timeout() {
+				return Retryable
+			}
+		}
+		switch err {
+		case syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE, syscall.ENETUNREACH, syscall.EHOSTUNREACH, io.ErrUnexpectedEOF:
+			return Retryable
+		}
+	}
+	return Permanent
+}
+
+// IsRejected reports whether err is the storage refusing a request, for
+// example for bad credentials or a missing bucket, so that it fails again
+// however long one waits. Unlike for Classify, errors not coming from the
+// storage, like for not reaching it, are not rejections.
+func IsRejected(err error) bool {
+	for _, err := range causes(err) {
+		if err == googleStorage.ErrBucketNotExist {
+			return true
+		}
+		if code, ok := statusCode(err); ok {
+			return classifyStatus(code) == Permanent
+		}
+	}
+	return false
+}
+
+// statusCode returns the HTTP status code of the response err is for, if any.
+func statusCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return e.Code, true
+	case minio.ErrorResponse:
+		return e.StatusCode, e.StatusCode != 0
+	case *oauth2.RetrieveError:
+		if e.Response != nil {
+			return e.Response.StatusCode, true
+		}
+	}
+	return 0, false
+}
+
+// causes returns err followed by the errors it wraps, as returned by the
+// standard library and the storage clients.
+func causes(err error) []error {
+	var res []error
+	for err != nil {
+		res = append(res, err)
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				res = append(res, causes(err)...)
+			}
+			err = nil
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			err = nil
+		}
+	}
+	return res
+}
+
+// classifyStatus classifies the HTTP status code of an error. Missing files
+// are translated to ErrNotExist by the storages, other 404s are for missing
+// buckets.
+func classifyStatus(code int) Class {
+	if code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500 {
+		return Retryable
+	}
+	return Permanent
+}
+
+// RetryPolicy tells how to retry operations failing with Retryable errors.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first.
+	Attempts int
+	// InitialBackoff is the longest wait before the first retry, doubled
+	// for every retry up to MaxBackoff. The waits are random, from zero to
+	// the longest wait.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// OnRetry, if set, is called before waiting to retry op, which failed
+	// with err.
+	OnRetry func(op string, err error)
+}
+
+// DefaultRetryPolicy returns the policy used by the command line tools.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Attempts:       5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// backoff returns how long to wait before the given retry, counting from 0.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Do calls fn until it succeeds, fails with an error which is not Retryable,
+// the attempts are exhausted or ctx is done. It returns the last error of fn.
+func (p *RetryPolicy) Do(ctx context.Context, op string, fn func(attempt int) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt+1 >= p.Attempts || Classify(err) != Retryable {
+			return err
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(op, err)
+		}
+		t := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// WithRetry returns a Storage retrying the operations of s according to p.
+// Put is only retried when its reader is an io.Seeker, and Get only until the
+// file is opened.
+func WithRetry(s Storage, p *RetryPolicy) Storage {
+	return &retryStorage{
+		s: s,
+		p: p,
+	}
+}
+
+type retryStorage struct {
+	s Storage
+	p *RetryPolicy
+}
+
+func (r *retryStorage) Upload(ctx context.Context, name string, contents []byte) error {
+	return r.p.Do(ctx, "upload", func(int) error {
+		return r.s.Upload(ctx, name, contents)
+	})
+}
+
+func (r *retryStorage) Download(ctx context.Context, name string) ([]byte, error) {
+	var res []byte
+	err := r.p.Do(ctx, "download", func(int) error {
+		var err error
+		res, err = r.s.Download(ctx, name)
+		return err
+	})
+	return res, err
+}
+
+func (r *retryStorage) Put(ctx context.Context, name string, rd io.Reader, opts *PutOptions) error {
+	seeker, ok := rd.(io.Seeker)
+	if !ok {
+		return r.s.Put(ctx, name, rd, opts)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return r.s.Put(ctx, name, rd, opts)
+	}
+	return r.p.Do(ctx, "put", func(attempt int) error {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		return r.s.Put(ctx, name, rd, opts)
+	})
+}
+
+func (r *retryStorage) Get(ctx context.Context, name string) (io.ReadCloser, Attrs, error) {
+	var rc io.ReadCloser
+	var attrs Attrs
+	err := r.p.Do(ctx, "get", func(int) error {
+		var err error
+		rc, attrs, err = r.s.Get(ctx, name)
+		return err
+	})
+	return rc, attrs, err
+}
+
+func (r *retryStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var res []string
+	err := r.p.Do(ctx, "list", func(int) error {
+		var err error
+		res, err = r.s.List(ctx, prefix)
+		return err
+	})
+	return res, err
+}
+
+// Delete succeeds if a retry finds the file missing, as an earlier attempt
+// may have deleted it.
+func (r *retryStorage) Delete(ctx context.Context, name string) error {
+	return r.p.Do(ctx, "delete", func(attempt int) error {
+		err := r.s.Delete(ctx, name)
+		if attempt > 0 && IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (r *retryStorage) Stat(ctx context.Context, name string) (Attrs, error) {
+	var attrs Attrs
+	err := r.p.Do(ctx, "stat", func(int) error {
+		var err error
+		attrs, err = r.s.Stat(ctx, name)
+		return err
+	})
+	return attrs, err
+}
+
+func (r *retryStorage) Copy(ctx context.Context, src, dst string) error {
+	return r.p.Do(ctx, "copy", func(int) error {
+		return r.s.Copy(ctx, src, dst)
+	})
+}
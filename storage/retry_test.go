@@ -0,0 +1,197 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	googleStorage "cloud.google.com/go/storage"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want storage.Class
+	}{
+		{storage.ErrNotExist, storage.NotFound},
+		{errors.New("bad request"), storage.Permanent},
+		{context.Canceled, storage.Permanent},
+		{&url.Error{Op: "Put", URL: "https://storage", Err: context.DeadlineExceeded}, storage.Permanent},
+		{&googleapi.Error{Code: 429}, storage.Retryable},
+		{&url.Error{Op: "Post", URL: "https://storage", Err: &googleapi.Error{Code: 503}}, storage.Retryable},
+		{&googleapi.Error{Code: 403}, storage.Permanent},
+		{&googleapi.Error{Code: 404}, storage.Permanent},
+		{minio.ErrorResponse{StatusCode: 500, Code: "InternalError"}, storage.Retryable},
+		{minio.ErrorResponse{StatusCode: 400, Code: "InvalidArgument"}, storage.Permanent},
+		{&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, storage.Retryable},
+		{&net.DNSError{IsTimeout: true}, storage.Retryable},
+		{&url.Error{Op: "Get", URL: "https://storage", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}}, storage.Retryable},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ENETUNREACH}}, storage.Retryable},
+		{io.ErrUnexpectedEOF, storage.Retryable},
+	} {
+		if got := storage.Classify(test.err); got != test.want {
+			t.Errorf("Classify(%v) want %v, got %v", test.err, test.want, got)
+		}
+	}
+}
+
+func TestIsRejected(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 403}, true},
+		{&url.Error{Op: "Get", URL: "https://storage", Err: &googleapi.Error{Code: 404}}, true},
+		{googleStorage.ErrBucketNotExist, true},
+		{&url.Error{Op: "Get", URL: "https://storage", Err: &oauth2.RetrieveError{Response: &http.Response{StatusCode: 400}}}, true},
+		{minio.ErrorResponse{StatusCode: 403, Code: "InvalidAccessKeyId"}, true},
+		{minio.ErrorResponse{StatusCode: 404, Code: "NoSuchBucket"}, true},
+		{&googleapi.Error{Code: 503}, false},
+		{minio.ErrorResponse{StatusCode: 429, Code: "SlowDown"}, false},
+		{storage.ErrNotExist, false},
+		{context.DeadlineExceeded, false},
+		{&url.Error{Op: "Get", URL: "https://storage", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}}, false},
+		{errors.New("oauth2: cannot fetch token: dial tcp: no route to host"), false},
+	} {
+		if got := storage.IsRejected(test.err); got != test.want {
+			t.Errorf("IsRejected(%v) want %v, got %v", test.err, test.want, got)
+		}
+	}
+}
+
+// flaky fails the first calls to each method with err.
+type flaky struct {
+	*storagetest.Memory
+	failures int
+	err      error
+	calls    map[string]int
+}
+
+func (f *flaky) fail(op string) error {
+	f.calls[op]++
+	if f.calls[op] <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flaky) Upload(ctx context.Context, name string, contents []byte) error {
+	if err := f.fail("upload"); err != nil {
+		return err
+	}
+	return f.Memory.Upload(ctx, name, contents)
+}
+
+func (f *flaky) Put(ctx context.Context, name string, r io.Reader, opts *storage.PutOptions) error {
+	if err := f.fail("put"); err != nil {
+		// Fail midway.
+		io.CopyN(ioutil.Discard, r, 3)
+		return err
+	}
+	return f.Memory.Put(ctx, name, r, opts)
+}
+
+func (f *flaky) Download(ctx context.Context, name string) ([]byte, error) {
+	if err := f.fail("download"); err != nil {
+		return nil, err
+	}
+	return f.Memory.Download(ctx, name)
+}
+
+func (f *flaky) Delete(ctx context.Context, name string) error {
+	err := f.Memory.Delete(ctx, name)
+	if ferr := f.fail("delete"); ferr != nil {
+		// Deleted, but the response was lost.
+		return ferr
+	}
+	return err
+}
+
+func newFlaky(failures int, err error) *flaky {
+	return &flaky{
+		Memory:   storagetest.NewMemory(),
+		failures: failures,
+		err:      err,
+		calls:    make(map[string]int),
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	transient := &googleapi.Error{Code: 503}
+	policy := &storage.RetryPolicy{
+		Attempts:       3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+	var retries []string
+	policy.OnRetry = func(op string, err error) {
+		retries = append(retries, op)
+	}
+
+	f := newFlaky(2, transient)
+	s := storage.WithRetry(f, policy)
+	if err := s.Upload(ctx, "a", []byte("contents")); err != nil {
+		t.Errorf("Upload() with 2 transient failures failed: %v", err)
+	}
+	if err := s.Put(ctx, "b", bytes.NewReader([]byte("contents")), nil); err != nil {
+		t.Errorf("Put() with 2 transient failures failed: %v", err)
+	}
+	if got, err := s.Download(ctx, "b"); err != nil || string(got) != "contents" {
+		t.Errorf("Download() want (contents, nil), got (%q, %v)", got, err)
+	}
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Errorf("Delete() with lost responses failed: %v", err)
+	}
+	if want := 8; len(retries) != want {
+		t.Errorf("OnRetry called %d times, want %d: %v", len(retries), want, retries)
+	}
+
+	f = newFlaky(3, transient)
+	s = storage.WithRetry(f, policy)
+	if err := s.Upload(ctx, "a", []byte("contents")); err != transient {
+		t.Errorf("Upload() with 3 transient failures want %v, got %v", transient, err)
+	}
+	// Readers which cannot be rewound are not retried.
+	if err := s.Put(ctx, "b", io.MultiReader(bytes.NewReader([]byte("contents"))), nil); err != transient || f.calls["put"] != 1 {
+		t.Errorf("Put() of a reader want %v after 1 call, got %v after %d", transient, err, f.calls["put"])
+	}
+
+	permanent := &googleapi.Error{Code: 403}
+	f = newFlaky(1, permanent)
+	s = storage.WithRetry(f, policy)
+	if err := s.Upload(ctx, "a", []byte("contents")); err != permanent || f.calls["upload"] != 1 {
+		t.Errorf("Upload() want %v after 1 call, got %v after %d", permanent, err, f.calls["upload"])
+	}
+	s.Download(ctx, "missing")
+	// Missing files are not retried either.
+	if _, err := s.Download(ctx, "missing"); !storage.IsNotExist(err) || f.calls["download"] != 2 {
+		t.Errorf("Download() of missing file want %v after 2 calls, got %v after %d", storage.ErrNotExist, err, f.calls["download"])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	f = newFlaky(1, transient)
+	s = storage.WithRetry(f, &storage.RetryPolicy{Attempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+	if err := s.Upload(ctx, "a", []byte("contents")); err != transient || f.calls["upload"] != 1 {
+		t.Errorf("Upload() after cancel want %v after 1 call, got %v after %d", transient, err, f.calls["upload"])
+	}
+}
+
+func TestRetryConformance(t *testing.T) {
+	storagetest.Conformance(t, storage.WithRetry(storagetest.NewMemory(), storage.DefaultRetryPolicy()))
+}
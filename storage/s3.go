@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/andreich/docsync/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize is the size of the parts of multipart uploads, which are used for
+// files larger than one part. Such uploads keep two parts in memory, see
+// PutBuffer.
+const s3PartSize = 16 * 1024 * 1024
+
+// NewS3 creates a Storage for a bucket of an S3-compatible object store, such
+// as Amazon S3 or MinIO.
+func NewS3(cfg *config.Storage) (Storage, error) {
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: !cfg.S3Insecure,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		client: client,
+		bucket: cfg.BucketName,
+	}, nil
+}
+
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3Storage) Upload(ctx context.Context, name string, contents []byte) error {
+	return upload(ctx, s, name, contents)
+}
+
+func (s *s3Storage) Download(ctx context.Context, name string) ([]byte, error) {
+	return download(ctx, s, name)
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader, opts *PutOptions) error {
+	putOpts := minio.PutObjectOptions{
+		PartSize: s3PartSize,
+		// The contents are authenticated by the encryption already.
+		DisableContentSha256: true,
+	}
+	if opts != nil {
+		putOpts.ContentType = opts.ContentType
+	}
+	// Files fitting in one part are uploaded with a single request, which
+	// needs the size in advance.
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, s3PartSize+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n <= s3PartSize {
+		_, err = s.client.PutObject(ctx, s.bucket, name, &buf, n, putOpts)
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, name, io.MultiReader(&buf, r), -1, putOpts)
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, Attrs, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, Attrs{}, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, Attrs{}, s3Error(err)
+	}
+	return obj, Attrs{
+		Name:    name,
+		Size:    info.Size,
+		Updated: info.LastModified,
+	}, nil
+}
+
+// Delete checks that name exists first, as deleting a missing object
+// succeeds in S3.
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if _, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{}); err != nil {
+		return s3Error(err)
+	}
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (Attrs, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return Attrs{}, s3Error(err)
+	}
+	attrs := Attrs{
+		Name:    name,
+		Size:    info.Size,
+		Updated: info.LastModified,
+	}
+	// The ETag is the MD5 of the contents only for objects not uploaded in
+	// multiple parts, which have a "-<parts>" suffix.
+	if sum, err := hex.DecodeString(strings.Trim(info.ETag, `"`)); err == nil && len(sum) == 16 {
+		attrs.MD5 = sum
+	}
+	return attrs, nil
+}
+
+func (s *s3Storage) Copy(ctx context.Context, src, dst string) error {
+	_, err := s.client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket: s.bucket,
+		Object: dst,
+	}, minio.CopySrcOptions{
+		Bucket: s.bucket,
+		Object: src,
+	})
+	return s3Error(err)
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	// Stops the listing if returning early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var res []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		res = append(res, obj.Key)
+	}
+	return res, nil
+}
+
+// s3Error translates the S3 errors with a meaning for Storage.
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotExist
+	}
+	return err
+}
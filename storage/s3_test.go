@@ -0,0 +1,172 @@
+package storage_test
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/config"
+	"github.com/andreich/docsync/storage"
+	"github.com/andreich/docsync/storage/storagetest"
+)
+
+type fakeS3Object struct {
+	data     []byte
+	modified time.Time
+}
+
+func (o fakeS3Object) etag() string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(o.data))
+}
+
+// fakeS3 implements enough of the S3 API, for path-style requests to a single
+// bucket, to exercise s3Storage.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Contents struct {
+	Key          string
+	LastModified string
+	Size         int64
+	ETag         string
+}
+
+type fakeS3CopyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []fakeS3Contents
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			f.error(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		res := fakeS3ListResult{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+		for key, obj := range f.objects {
+			if strings.HasPrefix(key, prefix) {
+				res.Contents = append(res.Contents, fakeS3Contents{
+					Key:          key,
+					LastModified: obj.modified.Format(time.RFC3339),
+					Size:         int64(len(obj.data)),
+					ETag:         obj.etag(),
+				})
+			}
+		}
+		sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+		res.KeyCount = len(res.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(res)
+		return
+	}
+	key := parts[1]
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			obj, found := f.objects[strings.TrimPrefix(strings.TrimPrefix(src, "/"), f.bucket+"/")]
+			if !found {
+				f.error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			obj.modified = time.Now().UTC()
+			f.objects[key] = obj
+			w.Header().Set("Content-Type", "application/xml")
+			xml.NewEncoder(w).Encode(fakeS3CopyResult{
+				LastModified: obj.modified.Format(time.RFC3339),
+				ETag:         obj.etag(),
+			})
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		obj := fakeS3Object{data: data, modified: time.Now().UTC()}
+		f.objects[key] = obj
+		w.Header().Set("ETag", obj.etag())
+	case http.MethodDelete:
+		// As in S3, deleting a missing object succeeds.
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		obj, found := f.objects[key]
+		if !found {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("ETag", obj.etag())
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// newFakeS3 starts a fake S3 server and returns a Storage connected to it.
+func newFakeS3(t *testing.T) (storage.Storage, func()) {
+	fake := &fakeS3{bucket: "backup", objects: map[string]fakeS3Object{}}
+	server := httptest.NewServer(fake)
+	s, err := storage.NewS3(&config.Storage{
+		Type:        config.StorageS3,
+		BucketName:  fake.bucket,
+		S3Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		S3Region:    "us-east-1",
+		S3AccessKey: "key",
+		S3SecretKey: "secret",
+		S3Insecure:  true,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("NewS3() failed: %v", err)
+	}
+	return s, server.Close
+}
+
+func TestS3(t *testing.T) {
+	s, cleanup := newFakeS3(t)
+	defer cleanup()
+	storagetest.Conformance(t, s)
+}
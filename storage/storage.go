@@ -1,16 +1,33 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"time"
 
+	"github.com/andreich/docsync/config"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	googleStorage "cloud.google.com/go/storage"
 )
 
-// Storage is the minimal interface for a cloud storage layer.
+// ErrNotExist is returned by all implementations of Storage when the file
+// requested does not exist.
+var ErrNotExist = errors.New("storage: file does not exist")
+
+// IsNotExist reports whether err means that the file requested does not exist.
+func IsNotExist(err error) bool {
+	return err == ErrNotExist
+}
+
+// Storage is the minimal interface for a cloud storage layer. List returns the
+// names sorted lexicographically.
 type Storage interface {
 	// Upload a file under the given name, with the provided contents.
 	Upload(ctx context.Context, name string, contents []byte) error
@@ -18,10 +35,101 @@ type Storage interface {
 	Download(ctx context.Context, name string) ([]byte, error)
 	// List contents of the bucket.
 	List(ctx context.Context, prefix string) ([]string, error)
+	// Put uploads everything read from r under the given name. opts may be
+	// nil.
+	Put(ctx context.Context, name string, r io.Reader, opts *PutOptions) error
+	// Get opens the file with the given name for reading. The caller must
+	// close the returned reader.
+	Get(ctx context.Context, name string) (io.ReadCloser, Attrs, error)
+	// Delete the file with the given name.
+	Delete(ctx context.Context, name string) error
+	// Stat returns the attributes of the file with the given name.
+	Stat(ctx context.Context, name string) (Attrs, error)
+	// Copy the file src to dst, without downloading it if the storage
+	// supports it.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// PutOptions are the optional settings of a Put.
+type PutOptions struct {
+	// ContentType of the file, if known.
+	ContentType string
+}
+
+// Attrs are the attributes of a stored file.
+type Attrs struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+	// MD5 of the stored contents, if known. Only Stat is required to set
+	// it, and only when the storage provides it.
+	MD5 []byte
+}
+
+// upload implements Storage.Upload on top of Storage.Put.
+func upload(ctx context.Context, s Storage, name string, contents []byte) error {
+	return s.Put(ctx, name, bytes.NewReader(contents), nil)
+}
+
+// download implements Storage.Download on top of Storage.Get.
+func download(ctx context.Context, s Storage, name string) ([]byte, error) {
+	r, _, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return data, r.Close()
 }
 
 var newClient = googleStorage.NewClient
 
+// FromConfig creates the Storage selected by the configuration.
+func FromConfig(ctx context.Context, cfg *config.Storage) (Storage, error) {
+	switch cfg.Type {
+	case config.StorageLocal:
+		return NewLocal(cfg.Path)
+	case config.StorageS3:
+		return NewS3(cfg)
+	case config.StorageGCS, "":
+		creds, err := json.Marshal(cfg.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		return New(ctx, cfg.BucketName, creds)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+}
+
+// PutBuffer returns how many bytes the storage configured by cfg keeps in
+// memory at most when writing size bytes with Put.
+func PutBuffer(cfg *config.Storage, size int64) int64 {
+	switch cfg.Type {
+	case config.StorageLocal:
+		// Written to the file as it comes.
+		return 0
+	case config.StorageS3:
+		if size <= s3PartSize {
+			return size
+		}
+		// Put reads the first part ahead to tell small objects apart, and
+		// minio buffers every part of a multipart upload again.
+		return 2 * s3PartSize
+	}
+	if size < gcsChunkSize {
+		return size
+	}
+	return gcsChunkSize
+}
+
+// gcsChunkSize is the size of the chunks of resumable uploads, each upload
+// keeping one chunk in memory.
+const gcsChunkSize = 16 * 1024 * 1024
+
 // New creates a new Google Cloud Storage client.
 func New(ctx context.Context, bucket string, creds []byte) (Storage, error) {
 	s, err := newClient(ctx, option.WithCredentialsJSON(creds))
@@ -41,25 +149,74 @@ type storageImpl struct {
 }
 
 func (s *storageImpl) Upload(ctx context.Context, name string, contents []byte) error {
-	obj := s.bucket.Object(name)
-	w := obj.NewWriter(ctx)
-	if _, err := w.Write(contents); err != nil {
+	return upload(ctx, s, name, contents)
+}
+
+func (s *storageImpl) Download(ctx context.Context, name string) ([]byte, error) {
+	return download(ctx, s, name)
+}
+
+func (s *storageImpl) Put(ctx context.Context, name string, r io.Reader, opts *PutOptions) error {
+	// Cancelling the context is the only way to abort a Writer without
+	// committing what was written so far.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.ChunkSize = gcsChunkSize
+	if opts != nil {
+		w.ContentType = opts.ContentType
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
 		return err
 	}
 	return w.Close()
 }
 
-func (s *storageImpl) Download(ctx context.Context, name string) ([]byte, error) {
-	obj := s.bucket.Object(name)
-	r, err := obj.NewReader(ctx)
+func (s *storageImpl) Get(ctx context.Context, name string) (io.ReadCloser, Attrs, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
 	if err != nil {
-		return nil, err
+		return nil, Attrs{}, gcsError(err)
 	}
-	data, err := ioutil.ReadAll(r)
+	return r, Attrs{
+		Name:    name,
+		Size:    r.Attrs.Size,
+		Updated: r.Attrs.LastModified,
+	}, nil
+}
+
+func (s *storageImpl) Delete(ctx context.Context, name string) error {
+	return gcsError(s.bucket.Object(name).Delete(ctx))
+}
+
+func (s *storageImpl) Stat(ctx context.Context, name string) (Attrs, error) {
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
 	if err != nil {
-		return nil, err
+		return Attrs{}, gcsError(err)
 	}
-	return data, r.Close()
+	return Attrs{
+		Name:    name,
+		Size:    attrs.Size,
+		Updated: attrs.Updated,
+		MD5:     attrs.MD5,
+	}, nil
+}
+
+func (s *storageImpl) Copy(ctx context.Context, src, dst string) error {
+	_, err := s.bucket.Object(dst).CopierFrom(s.bucket.Object(src)).Run(ctx)
+	return gcsError(err)
+}
+
+// gcsError translates the Google Cloud Storage errors with a meaning for
+// Storage. Newer clients wrap ErrObjectNotExist.
+func gcsError(err error) error {
+	for _, cause := range causes(err) {
+		if cause == googleStorage.ErrObjectNotExist {
+			return ErrNotExist
+		}
+	}
+	return err
 }
 
 func (s *storageImpl) List(ctx context.Context, prefix string) ([]string, error) {
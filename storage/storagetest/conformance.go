@@ -0,0 +1,229 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andreich/docsync/storage"
+)
+
+// Prefix is the prefix of all the files written by Conformance.
+const Prefix = "conformance/"
+
+// Conformance checks that s behaves as expected from a storage.Storage. There
+// should be no files starting with Prefix in s when it is called.
+func Conformance(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		desc string
+		fn   func(context.Context, *testing.T, storage.Storage)
+	}{
+		{"upload and download", testUploadDownload},
+		{"overwrite", testOverwrite},
+		{"put and get", testPutGet},
+		{"list", testList},
+		{"missing", testMissing},
+		{"stat", testStat},
+		{"delete", testDelete},
+		{"copy", testCopy},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			test.fn(ctx, t, s)
+		})
+	}
+}
+
+func name(s string) string {
+	return Prefix + s
+}
+
+func testUploadDownload(ctx context.Context, t *testing.T, s storage.Storage) {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	for fn, content := range map[string][]byte{
+		"empty":          {},
+		"text":           []byte("this is a test file"),
+		"binary":         binary,
+		"dir/nested":     []byte("nested file"),
+		"dir/sub/nested": []byte("deeper nested file"),
+	} {
+		if err := s.Upload(ctx, name(fn), content); err != nil {
+			t.Fatalf("Upload(%q) failed: %v", name(fn), err)
+		}
+		got, err := s.Download(ctx, name(fn))
+		if err != nil {
+			t.Fatalf("Download(%q) failed: %v", name(fn), err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Download(%q) want % x, got % x", name(fn), content, got)
+		}
+	}
+}
+
+func testOverwrite(ctx context.Context, t *testing.T, s storage.Storage) {
+	fn := name("overwritten")
+	for i := 0; i < 3; i++ {
+		content := []byte(strings.Repeat(fmt.Sprintf("version %d ", i), 3-i))
+		if err := s.Upload(ctx, fn, content); err != nil {
+			t.Fatalf("Upload(%q) failed: %v", fn, err)
+		}
+		got, err := s.Download(ctx, fn)
+		if err != nil {
+			t.Fatalf("Download(%q) failed: %v", fn, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Download(%q) want %q, got %q", fn, content, got)
+		}
+	}
+}
+
+func testPutGet(ctx context.Context, t *testing.T, s storage.Storage) {
+	fn := name("streamed")
+	content := bytes.Repeat([]byte("streamed content "), 10000)
+	if err := s.Put(ctx, fn, bytes.NewReader(content), &storage.PutOptions{ContentType: "text/plain"}); err != nil {
+		t.Fatalf("Put(%q) failed: %v", fn, err)
+	}
+	r, attrs, err := s.Get(ctx, fn)
+	if err != nil {
+		t.Fatalf("Get(%q) failed: %v", fn, err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("reading %q failed: %v", fn, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("closing %q failed: %v", fn, err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Get(%q) returned %d bytes, not the %d put", fn, len(got), len(content))
+	}
+	if attrs.Name != fn || attrs.Size != int64(len(content)) || attrs.Updated.IsZero() {
+		t.Errorf("Get(%q) unexpected attributes %+v", fn, attrs)
+	}
+}
+
+func testList(ctx context.Context, t *testing.T, s storage.Storage) {
+	for _, fn := range []string{"list/b", "list/a", "list/dir/c", "list2/d", "listing"} {
+		if err := s.Upload(ctx, name(fn), []byte(fn)); err != nil {
+			t.Fatalf("Upload(%q) failed: %v", name(fn), err)
+		}
+	}
+	for _, test := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"list/", []string{"list/a", "list/b", "list/dir/c"}},
+		{"list/dir", []string{"list/dir/c"}},
+		{"list", []string{"list/a", "list/b", "list/dir/c", "list2/d", "listing"}},
+		{"list/a", []string{"list/a"}},
+		{"nothing/", nil},
+	} {
+		got, err := s.List(ctx, name(test.prefix))
+		if err != nil {
+			t.Errorf("List(%q) failed: %v", name(test.prefix), err)
+			continue
+		}
+		var want []string
+		for _, fn := range test.want {
+			want = append(want, name(fn))
+		}
+		if len(got) != 0 || len(want) != 0 {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List(%q) want %v, got %v", name(test.prefix), want, got)
+			}
+		}
+	}
+}
+
+func testMissing(ctx context.Context, t *testing.T, s storage.Storage) {
+	if err := s.Upload(ctx, name("present/file"), []byte("present")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	for _, fn := range []string{"missing", "present/missing", "present"} {
+		if _, err := s.Download(ctx, name(fn)); !storage.IsNotExist(err) {
+			t.Errorf("Download(%q) want %v, got %v", name(fn), storage.ErrNotExist, err)
+		}
+		if _, _, err := s.Get(ctx, name(fn)); !storage.IsNotExist(err) {
+			t.Errorf("Get(%q) want %v, got %v", name(fn), storage.ErrNotExist, err)
+		}
+		if _, err := s.Stat(ctx, name(fn)); !storage.IsNotExist(err) {
+			t.Errorf("Stat(%q) want %v, got %v", name(fn), storage.ErrNotExist, err)
+		}
+		if err := s.Delete(ctx, name(fn)); !storage.IsNotExist(err) {
+			t.Errorf("Delete(%q) want %v, got %v", name(fn), storage.ErrNotExist, err)
+		}
+		if err := s.Copy(ctx, name(fn), name("copied")); !storage.IsNotExist(err) {
+			t.Errorf("Copy(%q) want %v, got %v", name(fn), storage.ErrNotExist, err)
+		}
+	}
+}
+
+func testStat(ctx context.Context, t *testing.T, s storage.Storage) {
+	fn := name("stat")
+	content := []byte("stat content")
+	if err := s.Upload(ctx, fn, content); err != nil {
+		t.Fatalf("Upload(%q) failed: %v", fn, err)
+	}
+	attrs, err := s.Stat(ctx, fn)
+	if err != nil {
+		t.Fatalf("Stat(%q) failed: %v", fn, err)
+	}
+	if attrs.Name != fn || attrs.Size != int64(len(content)) || attrs.Updated.IsZero() {
+		t.Errorf("Stat(%q) unexpected attributes %+v", fn, attrs)
+	}
+	if sum := md5.Sum(content); attrs.MD5 != nil && !bytes.Equal(attrs.MD5, sum[:]) {
+		t.Errorf("Stat(%q) want MD5 %x, got %x", fn, sum, attrs.MD5)
+	}
+}
+
+func testDelete(ctx context.Context, t *testing.T, s storage.Storage) {
+	for _, fn := range []string{"delete/a", "delete/dir/b"} {
+		if err := s.Upload(ctx, name(fn), []byte(fn)); err != nil {
+			t.Fatalf("Upload(%q) failed: %v", name(fn), err)
+		}
+	}
+	if err := s.Delete(ctx, name("delete/dir/b")); err != nil {
+		t.Fatalf("Delete(%q) failed: %v", name("delete/dir/b"), err)
+	}
+	if _, err := s.Download(ctx, name("delete/dir/b")); !storage.IsNotExist(err) {
+		t.Errorf("Download(%q) after Delete want %v, got %v", name("delete/dir/b"), storage.ErrNotExist, err)
+	}
+	got, err := s.List(ctx, name("delete/"))
+	if err != nil {
+		t.Fatalf("List(%q) failed: %v", name("delete/"), err)
+	}
+	if want := []string{name("delete/a")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(%q) after Delete want %v, got %v", name("delete/"), want, got)
+	}
+}
+
+func testCopy(ctx context.Context, t *testing.T, s storage.Storage) {
+	src, dst := name("copy/src"), name("copy/dir/dst")
+	content := []byte("copied content")
+	if err := s.Upload(ctx, src, content); err != nil {
+		t.Fatalf("Upload(%q) failed: %v", src, err)
+	}
+	if err := s.Upload(ctx, dst, []byte("overwritten by the copy")); err != nil {
+		t.Fatalf("Upload(%q) failed: %v", dst, err)
+	}
+	if err := s.Copy(ctx, src, dst); err != nil {
+		t.Fatalf("Copy(%q, %q) failed: %v", src, dst, err)
+	}
+	for _, fn := range []string{src, dst} {
+		got, err := s.Download(ctx, fn)
+		if err != nil {
+			t.Fatalf("Download(%q) failed: %v", fn, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Download(%q) after Copy want %q, got %q", fn, content, got)
+		}
+	}
+}
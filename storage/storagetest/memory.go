@@ -0,0 +1,158 @@
+// Package storagetest provides an in-memory storage.Storage for tests and a
+// conformance suite checking that implementations of storage.Storage behave
+// the same.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreich/docsync/storage"
+)
+
+type object struct {
+	data    []byte
+	updated time.Time
+}
+
+// Memory is a storage.Storage keeping the files in memory. It is safe for
+// concurrent use.
+type Memory struct {
+	mu      sync.Mutex
+	objects map[string]object
+}
+
+// NewMemory creates an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{
+		objects: make(map[string]object),
+	}
+}
+
+// Upload satisfies storage.Storage.
+func (m *Memory) Upload(ctx context.Context, name string, contents []byte) error {
+	return m.Put(ctx, name, bytes.NewReader(contents), nil)
+}
+
+// Download satisfies storage.Storage.
+func (m *Memory) Download(ctx context.Context, name string) ([]byte, error) {
+	r, _, err := m.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Put satisfies storage.Storage.
+func (m *Memory) Put(ctx context.Context, name string, r io.Reader, opts *storage.PutOptions) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = object{
+		data:    data,
+		updated: time.Now(),
+	}
+	return nil
+}
+
+// Get satisfies storage.Storage.
+func (m *Memory) Get(ctx context.Context, name string) (io.ReadCloser, storage.Attrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, storage.Attrs{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, found := m.objects[name]
+	if !found {
+		return nil, storage.Attrs{}, storage.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), storage.Attrs{
+		Name:    name,
+		Size:    int64(len(obj.data)),
+		Updated: obj.updated,
+	}, nil
+}
+
+// Delete satisfies storage.Storage.
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.objects[name]; !found {
+		return storage.ErrNotExist
+	}
+	delete(m.objects, name)
+	return nil
+}
+
+// Stat satisfies storage.Storage.
+func (m *Memory) Stat(ctx context.Context, name string) (storage.Attrs, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Attrs{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, found := m.objects[name]
+	if !found {
+		return storage.Attrs{}, storage.ErrNotExist
+	}
+	sum := md5.Sum(obj.data)
+	return storage.Attrs{
+		Name:    name,
+		Size:    int64(len(obj.data)),
+		Updated: obj.updated,
+		MD5:     sum[:],
+	}, nil
+}
+
+// Copy satisfies storage.Storage.
+func (m *Memory) Copy(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, found := m.objects[src]
+	if !found {
+		return storage.ErrNotExist
+	}
+	// Objects are never modified in place, so the data can be shared.
+	m.objects[dst] = object{
+		data:    obj.data,
+		updated: time.Now(),
+	}
+	return nil
+}
+
+// List satisfies storage.Storage.
+func (m *Memory) List(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []string
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
@@ -0,0 +1,7 @@
+package storagetest
+
+import "testing"
+
+func TestMemory(t *testing.T) {
+	Conformance(t, NewMemory())
+}
@@ -0,0 +1,122 @@
+// Package uploader runs uploads concurrently, bounding both their number and
+// the memory used by the data in flight.
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Job is a file to upload.
+type Job struct {
+	// Src is the local file.
+	Src string
+	// Dst is the remote file.
+	Dst string
+	// Memory used by uploading Src, like the data buffered by the
+	// encryption and the storage, bounding the uploads in flight.
+	Memory int64
+	// Hash is the MD5 of Src when the change was found, for uploads named
+	// after the contents.
+	Hash [md5.Size]byte
+}
+
+// UploadFunc uploads a file, giving up when ctx is done.
+type UploadFunc func(ctx context.Context, job Job) error
+
+// Pool uploads files with a number of workers.
+type Pool struct {
+	concurrency int
+	timeout     time.Duration
+	maxBytes    int64
+	upload      UploadFunc
+}
+
+// New creates a Pool uploading at most concurrency files at once, each with
+// upload given at most timeout if positive. Uploads in flight use at most
+// maxBytes of memory in total, where each upload uses its Job.Memory.
+func New(concurrency int, timeout time.Duration, maxBytes int64, upload UploadFunc) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if maxBytes < 1 {
+		maxBytes = 1
+	}
+	return &Pool{
+		concurrency: concurrency,
+		timeout:     timeout,
+		maxBytes:    maxBytes,
+		upload:      upload,
+	}
+}
+
+type result struct {
+	i   int
+	err error
+}
+
+// Run uploads jobs and calls done with the outcome of each, in the order of
+// jobs, from the goroutine calling Run. It returns once all are done; the
+// jobs not started when ctx is done fail with the error of ctx.
+func (p *Pool) Run(ctx context.Context, jobs []Job, done func(Job, error)) {
+	sem := semaphore.NewWeighted(p.maxBytes)
+	slots := make(chan struct{}, p.concurrency)
+	results := make(chan result)
+	go func() {
+		for i, job := range jobs {
+			weight := p.weight(job)
+			if err := sem.Acquire(ctx, weight); err != nil {
+				results <- result{i, err}
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				sem.Release(weight)
+				results <- result{i, ctx.Err()}
+				continue
+			}
+			go func(i int, job Job) {
+				err := p.run(ctx, job)
+				<-slots
+				sem.Release(weight)
+				results <- result{i, err}
+			}(i, job)
+		}
+	}()
+
+	errs := make([]error, len(jobs))
+	finished := make([]bool, len(jobs))
+	next := 0
+	for range jobs {
+		r := <-results
+		errs[r.i], finished[r.i] = r.err, true
+		for ; next < len(jobs) && finished[next]; next++ {
+			done(jobs[next], errs[next])
+		}
+	}
+}
+
+// weight returns the memory used by uploading job, as accounted against
+// maxBytes.
+func (p *Pool) weight(job Job) int64 {
+	if job.Memory < 1 {
+		return 1
+	}
+	if job.Memory > p.maxBytes {
+		return p.maxBytes
+	}
+	return job.Memory
+}
+
+func (p *Pool) run(ctx context.Context, job Job) error {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	return p.upload(ctx, job)
+}
@@ -0,0 +1,117 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tracker records the uploads in flight.
+type tracker struct {
+	mu                 sync.Mutex
+	count, bytes       int64
+	maxCount, maxBytes int64
+}
+
+func (t *tracker) upload(ctx context.Context, job Job) error {
+	t.mu.Lock()
+	t.count++
+	t.bytes += job.Memory
+	if t.count > t.maxCount {
+		t.maxCount = t.count
+	}
+	if t.bytes > t.maxBytes {
+		t.maxBytes = t.bytes
+	}
+	t.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	t.mu.Lock()
+	t.count--
+	t.bytes -= job.Memory
+	t.mu.Unlock()
+	if job.Src == "fail" {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		concurrency int
+		maxBytes    int64
+		sizes       []int64
+		wantCount   int64
+		wantBytes   int64
+	}{
+		{"bounded by concurrency", 3, 1000, []int64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, 3, 3},
+		{"bounded by memory", 10, 100, []int64{50, 50, 50, 50, 50, 50}, 2, 100},
+		{"large files one at a time", 10, 100, []int64{500, 200, 100}, 1, 500},
+		{"serial", 0, 0, []int64{1, 2, 3}, 1, 3},
+	} {
+		var jobs []Job
+		for i, size := range test.sizes {
+			jobs = append(jobs, Job{Src: fmt.Sprint(i), Memory: size})
+		}
+		tr := &tracker{}
+		var got []Job
+		New(test.concurrency, 0, test.maxBytes, tr.upload).Run(context.Background(), jobs, func(job Job, err error) {
+			if err != nil {
+				t.Errorf("%s: uploading %v failed: %v", test.desc, job, err)
+			}
+			got = append(got, job)
+		})
+		if !reflect.DeepEqual(got, jobs) {
+			t.Errorf("%s: done want %v, got %v", test.desc, jobs, got)
+		}
+		if tr.maxCount > test.wantCount {
+			t.Errorf("%s: want at most %d uploads in flight, got %d", test.desc, test.wantCount, tr.maxCount)
+		}
+		if tr.maxBytes > test.wantBytes {
+			t.Errorf("%s: want at most %d bytes in flight, got %d", test.desc, test.wantBytes, tr.maxBytes)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	slow := func(ctx context.Context, job Job) error {
+		switch job.Src {
+		case "fail":
+			return errors.New("failed")
+		case "slow":
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	jobs := []Job{{Src: "slow"}, {Src: "ok"}, {Src: "fail"}, {Src: "ok"}}
+	errs := make(map[int]error)
+	i := 0
+	New(2, 10*time.Millisecond, 10, slow).Run(context.Background(), jobs, func(job Job, err error) {
+		errs[i] = err
+		i++
+	})
+	if len(errs) != len(jobs) {
+		t.Fatalf("done called %d times, want %d", len(errs), len(jobs))
+	}
+	if errs[0] != context.DeadlineExceeded || errs[1] != nil || errs[2] == nil || errs[3] != nil {
+		t.Errorf("want errors [%v <nil> failed <nil>], got %v", context.DeadlineExceeded, errs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n := 0
+	New(2, 0, 10, slow).Run(ctx, jobs, func(job Job, err error) {
+		if err == nil && job.Src == "slow" {
+			t.Errorf("upload of %v want error after cancel, got nil", job)
+		}
+		n++
+	})
+	if n != len(jobs) {
+		t.Errorf("done called %d times after cancel, want %d", n, len(jobs))
+	}
+}
@@ -0,0 +1,103 @@
+// Package versions names the previous versions of synced files kept in
+// storage, and decides which of them to keep.
+package versions
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/andreich/docsync/manifest"
+)
+
+// DefaultPrefix is prepended to the remote name of versions by default.
+const DefaultPrefix = "versions/"
+
+// timeFormat sorts like the times, as long as they are in UTC.
+const timeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// Name returns the remote name of the version of the file stored as name,
+// modified at mod.
+func Name(prefix, name string, mod time.Time) string {
+	return prefix + name + "@" + mod.UTC().Format(timeFormat)
+}
+
+// Policy tells which versions of a file to keep. Versions are kept if any of
+// the rules keeps them.
+type Policy struct {
+	// Keep is how many of the newest versions to keep.
+	Keep int `json:"keep"`
+	// Daily, Weekly and Monthly are how many of the last days, weeks and
+	// months having versions to keep the newest version of. Days start at
+	// midnight UTC, weeks on Monday.
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+// Validate returns an error if the policy has negative counts.
+func (p *Policy) Validate() error {
+	if p.Keep < 0 || p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 {
+		return fmt.Errorf("keep, daily, weekly and monthly should not be negative")
+	}
+	return nil
+}
+
+// Enabled reports whether the policy keeps any version.
+func (p *Policy) Enabled() bool {
+	return p.Keep > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0
+}
+
+// periods are the days, weeks and months of the policy, with count returning
+// how many to keep and key the period of a time.
+var periods = []struct {
+	count func(p *Policy) int
+	key   func(t time.Time) string
+}{
+	{
+		func(p *Policy) int { return p.Daily },
+		func(t time.Time) string { return t.Format("2006-01-02") },
+	},
+	{
+		func(p *Policy) int { return p.Weekly },
+		func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		},
+	},
+	{
+		func(p *Policy) int { return p.Monthly },
+		func(t time.Time) string { return t.Format("2006-01") },
+	},
+}
+
+// Apply splits versions into those the policy keeps and the expired ones,
+// both sorted from oldest to newest.
+func (p *Policy) Apply(versions []manifest.Version) (kept, expired []manifest.Version) {
+	sorted := append([]manifest.Version(nil), versions...)
+	sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].Mod.Before(sorted[b].Mod) })
+
+	keep := make([]bool, len(sorted))
+	for i := 0; i < p.Keep && i < len(sorted); i++ {
+		keep[len(sorted)-1-i] = true
+	}
+	for _, pd := range periods {
+		left := pd.count(p)
+		last := ""
+		for i := len(sorted) - 1; i >= 0 && left > 0; i-- {
+			if key := pd.key(sorted[i].Mod.UTC()); key != last {
+				keep[i] = true
+				last = key
+				left--
+			}
+		}
+	}
+	for i, v := range sorted {
+		if keep[i] {
+			kept = append(kept, v)
+		} else {
+			expired = append(expired, v)
+		}
+	}
+	return kept, expired
+}
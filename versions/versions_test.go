@@ -0,0 +1,75 @@
+package versions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andreich/docsync/manifest"
+)
+
+func TestName(t *testing.T) {
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("CET", 3600))
+	if got, want := Name("versions/", "docs/a.pdf", mod), "versions/docs/a.pdf@2020-01-02T02:04:05.000000006Z"; got != want {
+		t.Errorf("Name() want %q, got %q", want, got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	day := func(month time.Month, day, hour int) manifest.Version {
+		mod := time.Date(2021, month, day, hour, 0, 0, 0, time.UTC)
+		return manifest.Version{Name: mod.Format("Jan 2 15h"), Mod: mod}
+	}
+	// Fri Jan 29 to Wed Feb 3, twice on Feb 2 and 3.
+	versions := []manifest.Version{
+		day(2, 3, 12), day(2, 3, 10), day(2, 2, 12), day(2, 2, 10),
+		day(2, 1, 10), day(1, 31, 10), day(1, 30, 10), day(1, 29, 10),
+	}
+	for _, test := range []struct {
+		desc   string
+		policy Policy
+		want   []manifest.Version
+	}{
+		{
+			desc: "nothing",
+		},
+		{
+			desc:   "keep",
+			policy: Policy{Keep: 3},
+			want:   []manifest.Version{day(2, 2, 12), day(2, 3, 10), day(2, 3, 12)},
+		},
+		{
+			desc:   "daily",
+			policy: Policy{Daily: 3},
+			want:   []manifest.Version{day(2, 1, 10), day(2, 2, 12), day(2, 3, 12)},
+		},
+		{
+			desc:   "weekly",
+			policy: Policy{Weekly: 2},
+			want:   []manifest.Version{day(1, 31, 10), day(2, 3, 12)},
+		},
+		{
+			desc:   "monthly",
+			policy: Policy{Monthly: 5},
+			want:   []manifest.Version{day(1, 31, 10), day(2, 3, 12)},
+		},
+		{
+			desc:   "combined",
+			policy: Policy{Keep: 2, Daily: 2, Monthly: 2},
+			want:   []manifest.Version{day(1, 31, 10), day(2, 2, 12), day(2, 3, 10), day(2, 3, 12)},
+		},
+		{
+			desc:   "more than versions",
+			policy: Policy{Keep: 100},
+			want:   []manifest.Version{day(1, 29, 10), day(1, 30, 10), day(1, 31, 10), day(2, 1, 10), day(2, 2, 10), day(2, 2, 12), day(2, 3, 10), day(2, 3, 12)},
+		},
+	} {
+		kept, expired := test.policy.Apply(versions)
+		if !reflect.DeepEqual(kept, test.want) {
+			t.Errorf("%s: Apply() want kept %v, got %v", test.desc, test.want, kept)
+		}
+		if len(kept)+len(expired) != len(versions) {
+			t.Errorf("%s: Apply() returned %d kept and %d expired of %d versions", test.desc, len(kept), len(expired), len(versions))
+		}
+	}
+}
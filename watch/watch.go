@@ -0,0 +1,170 @@
+// Package watch reports the directories in which files change, using file
+// system notifications instead of scanning the directories.
+package watch
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxDelays is how many times the delay a batch of changes can be held back by
+// events arriving continuously.
+const maxDelays = 10
+
+// Watcher watches a set of directory trees, including the directories created
+// after it started.
+type Watcher struct {
+	roots []string
+	delay time.Duration
+	w     *fsnotify.Watcher
+	c     chan []string
+	done  chan struct{}
+}
+
+// New starts watching the trees rooted at dirs. Changes are reported once no
+// event arrived for delay.
+func New(dirs []string, delay time.Duration) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		delay: delay,
+		w:     fw,
+		c:     make(chan []string),
+		done:  make(chan struct{}),
+	}
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		w.roots = append(w.roots, dir)
+		if err := w.add(dir); err != nil {
+			fw.Close()
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// C returns the channel on which batches of changed directories are sent,
+// sorted and without the subdirectories of other directories in the batch.
+// Scanning a directory of a batch, with its subdirectories, finds all the
+// changes. The channel is closed by Close.
+func (w *Watcher) C() <-chan []string {
+	return w.c
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.w.Close()
+}
+
+// add watches dir and its subdirectories.
+func (w *Watcher) add(dir string) error {
+	return filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Removed since listed, the removal has an event too.
+			if os.IsNotExist(err) && fn != dir {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return w.w.Add(fn)
+	})
+}
+
+// dir returns the directory to scan for changes to fn.
+func (w *Watcher) dir(fn string) string {
+	for _, root := range w.roots {
+		if fn == root {
+			return root
+		}
+	}
+	return filepath.Dir(fn)
+}
+
+func (w *Watcher) run() {
+	defer close(w.c)
+	changed := make(map[string]bool)
+	var quiet, deadline <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if st, err := os.Stat(ev.Name); err == nil && st.IsDir() {
+					if err := w.add(ev.Name); err != nil {
+						log.Printf("Could not watch %q: %v", ev.Name, err)
+					}
+				}
+			}
+			changed[w.dir(ev.Name)] = true
+			quiet = time.After(w.delay)
+			if deadline == nil {
+				deadline = time.After(maxDelays * w.delay)
+			}
+			continue
+		case err, ok := <-w.w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watching failed: %v", err)
+			if err != fsnotify.ErrEventOverflow {
+				continue
+			}
+			// Events were lost, everything needs to be scanned.
+			for _, root := range w.roots {
+				changed[root] = true
+			}
+		case <-quiet:
+		case <-deadline:
+		}
+		select {
+		case w.c <- batch(changed):
+		case <-w.done:
+			return
+		}
+		changed = make(map[string]bool)
+		quiet, deadline = nil, nil
+	}
+}
+
+// batch returns the sorted directories in changed, without the ones within
+// other directories.
+func batch(changed map[string]bool) []string {
+	var dirs []string
+	for dir := range changed {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	var res []string
+next:
+	for _, dir := range dirs {
+		for _, parent := range res {
+			if within(dir, parent) {
+				continue next
+			}
+		}
+		res = append(res, dir)
+	}
+	return res
+}
+
+// within reports whether fn is dir or within it.
+func within(fn, dir string) bool {
+	return fn == dir || strings.HasPrefix(fn, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
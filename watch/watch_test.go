@@ -0,0 +1,93 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	for _, test := range []struct {
+		changed []string
+		want    []string
+	}{
+		{nil, nil},
+		{[]string{"/a"}, []string{"/a"}},
+		{[]string{"/a/b", "/a", "/a/b/c"}, []string{"/a"}},
+		{[]string{"/a/b", "/a-b", "/a/c"}, []string{"/a-b", "/a/b", "/a/c"}},
+		{[]string{"/a/b", "/a-b", "/a"}, []string{"/a", "/a-b"}},
+	} {
+		changed := make(map[string]bool)
+		for _, dir := range test.changed {
+			changed[dir] = true
+		}
+		if got := batch(changed); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("batch(%v) want %v, got %v", test.changed, test.want, got)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0700); err != nil {
+		t.Fatalf("MkdirAll() failed: %v", err)
+	}
+	w, err := New([]string{root}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	defer w.Close()
+
+	next := func(desc string) []string {
+		select {
+		case dirs := <-w.C():
+			return dirs
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no changes reported", desc)
+		}
+		return nil
+	}
+	write := func(fn string) {
+		if err := ioutil.WriteFile(filepath.Join(root, fn), []byte(fn), 0600); err != nil {
+			t.Fatalf("WriteFile(%q) failed: %v", fn, err)
+		}
+	}
+
+	write("a/b/f1")
+	write("a/b/f2")
+	if got, want := next("nested files"), []string{filepath.Join(root, "a", "b")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nested files: want %v, got %v", want, got)
+	}
+
+	write("f3")
+	write("a/b/f3")
+	if got, want := next("files in root and subdirectory"), []string{root}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files in root and subdirectory: want %v, got %v", want, got)
+	}
+
+	// New directories are watched too.
+	if err := os.Mkdir(filepath.Join(root, "c"), 0700); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+	if got, want := next("new directory"), []string{root}; !reflect.DeepEqual(got, want) {
+		t.Errorf("new directory: want %v, got %v", want, got)
+	}
+	write("c/f4")
+	if got, want := next("file in new directory"), []string{filepath.Join(root, "c")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("file in new directory: want %v, got %v", want, got)
+	}
+
+	if err := os.Remove(filepath.Join(root, "a", "b", "f1")); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if got, want := next("removed file"), []string{filepath.Join(root, "a", "b")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removed file: want %v, got %v", want, got)
+	}
+}